@@ -2,59 +2,702 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Log represents the log settings
 type Log struct {
-	Level int32 `yaml:"level"`
+	Level    int32            `yaml:"level"`
+	Format   string           `yaml:"format"`
+	Prefixes map[string]int32 `yaml:"prefixes"`
+}
+
+// LeaderElection represents the leader election settings
+type LeaderElection struct {
+	Enabled        bool          `yaml:"enabled"`
+	LeaseName      string        `yaml:"leaseName"`
+	LeaseNamespace string        `yaml:"leaseNamespace"`
+	LeaseDuration  time.Duration `yaml:"leaseDuration"`
+	RenewDeadline  time.Duration `yaml:"renewDeadline"`
+	RetryPeriod    time.Duration `yaml:"retryPeriod"`
+}
+
+// Rate limiter types of the controller queues
+const (
+	// RateLimiterExponential delays the retries of every failed item exponentially, from BaseDelay up to MaxDelay
+	RateLimiterExponential = "exponential"
+	// RateLimiterBucket limits the items added to the queue to QPS per second, allowing bursts of Burst items
+	RateLimiterBucket = "bucket"
+	// RateLimiterMax delays the items by the longer delay of both the exponential and the bucket limiters
+	RateLimiterMax = "max"
+)
+
+// RateLimiter represents the rate limiter settings of a controller queue.
+// Unset settings of a controller fall back to the manager settings.
+type RateLimiter struct {
+	Type      string        `yaml:"type"`
+	BaseDelay time.Duration `yaml:"baseDelay"`
+	MaxDelay  time.Duration `yaml:"maxDelay"`
+	QPS       float64       `yaml:"qps"`
+	Burst     int32         `yaml:"burst"`
+}
+
+// override returns the rate limiter settings overridden by the set settings of o
+func (r RateLimiter) override(o RateLimiter) RateLimiter {
+	if o.Type != "" {
+		r.Type = o.Type
+	}
+	if o.BaseDelay != 0 {
+		r.BaseDelay = o.BaseDelay
+	}
+	if o.MaxDelay != 0 {
+		r.MaxDelay = o.MaxDelay
+	}
+	if o.QPS != 0 {
+		r.QPS = o.QPS
+	}
+	if o.Burst != 0 {
+		r.Burst = o.Burst
+	}
+	return r
 }
 
 // Manager represents the manager settings
 type Manager struct {
-	ThreadNumber            int32         `yaml:"threadNumber"`
-	ControllerMaxRetryTimes int32         `yaml:"controllerMaxRetryTimes"`
-	ThreadTimeout           time.Duration `yaml:"threadTimeout"`
-	ReSyncPeriod            time.Duration `yaml:"reSyncPeriod"`
+	ThreadNumber            int32          `yaml:"threadNumber"`
+	ControllerMaxRetryTimes int32          `yaml:"controllerMaxRetryTimes"`
+	ThreadTimeout           time.Duration  `yaml:"threadTimeout"`
+	ReSyncPeriod            time.Duration  `yaml:"reSyncPeriod"`
+	ReconcileTimeout        time.Duration  `yaml:"reconcileTimeout"`
+	ShutdownTimeout         time.Duration  `yaml:"shutdownTimeout"`
+	MetricsAddress          string         `yaml:"metricsAddress"`
+	HealthProbeAddress      string         `yaml:"healthProbeAddress"`
+	AdminAddress            string         `yaml:"adminAddress"`
+	LivenessThreshold       time.Duration  `yaml:"livenessThreshold"`
+	LeaderElection          LeaderElection `yaml:"leaderElection"`
+	RateLimiter             RateLimiter    `yaml:"rateLimiter"`
+}
+
+// Controller represents the settings of a controller in the controllers section, keyed by its name.
+// Unset settings fall back to the manager settings or to the defaults of the controller.
+type Controller struct {
+	Enabled          *bool             `yaml:"enabled"`
+	Workers          int32             `yaml:"workers"`
+	MaxRetries       *int32            `yaml:"maxRetries"`
+	ReSyncPeriod     *time.Duration    `yaml:"reSyncPeriod"`
+	ReconcileTimeout *time.Duration    `yaml:"reconcileTimeout"`
+	Namespace        *string           `yaml:"namespace"`
+	LabelSelector    *string           `yaml:"labelSelector"`
+	RateLimiter      RateLimiter       `yaml:"rateLimiter"`
+	Settings         map[string]string `yaml:"settings"`
+}
+
+// ControllerSettings represents the resolved settings of a controller.
+// Namespace and LabelSelector are nil if the controller defaults are kept.
+type ControllerSettings struct {
+	Enabled          bool
+	Workers          int32
+	MaxRetries       int32
+	ReSyncPeriod     time.Duration
+	ReconcileTimeout time.Duration
+	Namespace        *string
+	LabelSelector    *string
+	RateLimiter      RateLimiter
+	Settings         map[string]string
 }
 
 // Config represents the overall configuration
 type Config struct {
-	Log     Log     `yaml:"log"`
-	Manager Manager `yaml:"manager"`
-}
-
-// Cfg is the global configuration variable
-var Cfg Config
-
-// init initializes the configuration
-func init() {
-	// Set the configuration file name and path
-	viper.SetConfigName("config")
-	viper.AddConfigPath("../config")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath("..")
-	viper.AddConfigPath(".")
-	viper.SetConfigType("yaml")
-	// Set default values for configuration settings
-	viper.SetDefault("log.level", 4)
-	viper.SetDefault("manager.threadNumber", 1)
-	viper.SetDefault("manager.controllerMaxRetryTimes", 5)
-	viper.SetDefault("manager.threadTimeout", 5)
-	viper.SetDefault("manager.reSyncPeriod", 300)
-	// Read the configuration file
-	err := viper.ReadInConfig()
+	Log         Log                   `yaml:"log"`
+	Manager     Manager               `yaml:"manager"`
+	Controllers map[string]Controller `yaml:"controllers"`
+}
+
+// ControllerSettings returns the settings of the named controller, falling back to the manager settings.
+// Controllers are enabled unless disabled, settings keys are lower case.
+func (c Config) ControllerSettings(name string) ControllerSettings {
+	controller := c.Controllers[strings.ToLower(name)]
+	settings := ControllerSettings{
+		Enabled:          controller.Enabled == nil || *controller.Enabled,
+		Workers:          c.Manager.ThreadNumber,
+		MaxRetries:       c.Manager.ControllerMaxRetryTimes,
+		ReSyncPeriod:     c.Manager.ReSyncPeriod,
+		ReconcileTimeout: c.Manager.ReconcileTimeout,
+		Namespace:        controller.Namespace,
+		LabelSelector:    controller.LabelSelector,
+		RateLimiter:      c.Manager.RateLimiter.override(controller.RateLimiter),
+		Settings:         map[string]string{},
+	}
+	if controller.Workers > 0 {
+		settings.Workers = controller.Workers
+	}
+	if controller.MaxRetries != nil {
+		settings.MaxRetries = *controller.MaxRetries
+	}
+	if controller.ReSyncPeriod != nil {
+		settings.ReSyncPeriod = *controller.ReSyncPeriod
+	}
+	if controller.ReconcileTimeout != nil {
+		settings.ReconcileTimeout = *controller.ReconcileTimeout
+	}
+	for key, value := range controller.Settings {
+		settings.Settings[strings.ToLower(key)] = value
+	}
+	return settings
+}
+
+// Cfg is the global configuration variable, holding the defaults until main loads the config file
+var Cfg = Default()
+
+// defaults are the default values of the configuration settings
+var defaults = []struct {
+	key   string
+	value interface{}
+}{
+	{"log.level", 4},
+	{"log.format", "text"},
+	{"manager.threadNumber", 1},
+	{"manager.controllerMaxRetryTimes", 5},
+	{"manager.threadTimeout", 5 * time.Second},
+	{"manager.reSyncPeriod", 300 * time.Second},
+	{"manager.reconcileTimeout", 60 * time.Second},
+	{"manager.shutdownTimeout", 30 * time.Second},
+	{"manager.metricsAddress", ":9090"},
+	{"manager.healthProbeAddress", ":8081"},
+	{"manager.adminAddress", "127.0.0.1:8082"},
+	{"manager.livenessThreshold", 120 * time.Second},
+	{"manager.leaderElection.enabled", false},
+	{"manager.leaderElection.leaseName", "kontroller"},
+	{"manager.leaderElection.leaseNamespace", "default"},
+	{"manager.leaderElection.leaseDuration", 15 * time.Second},
+	{"manager.leaderElection.renewDeadline", 10 * time.Second},
+	{"manager.leaderElection.retryPeriod", 2 * time.Second},
+	{"manager.rateLimiter.type", RateLimiterMax},
+	{"manager.rateLimiter.baseDelay", 5 * time.Millisecond},
+	{"manager.rateLimiter.maxDelay", 1000 * time.Second},
+	{"manager.rateLimiter.qps", 10.0},
+	{"manager.rateLimiter.burst", 100},
+}
+
+// durationKeys are the settings holding durations like "30s" or "5m", or plain numbers of seconds
+var durationKeys = []string{
+	"manager.threadTimeout",
+	"manager.reSyncPeriod",
+	"manager.reconcileTimeout",
+	"manager.shutdownTimeout",
+	"manager.livenessThreshold",
+	"manager.leaderElection.leaseDuration",
+	"manager.leaderElection.renewDeadline",
+	"manager.leaderElection.retryPeriod",
+	"manager.rateLimiter.baseDelay",
+	"manager.rateLimiter.maxDelay",
+}
+
+// controllerKeys are the settings of a controller in the controllers section
+var controllerKeys = []string{"enabled", "workers", "maxRetries", "reSyncPeriod", "reconcileTimeout", "namespace", "labelSelector", "rateLimiter", "settings"}
+
+// rateLimiterKeys are the settings of a rate limiter
+var rateLimiterKeys = []string{"type", "baseDelay", "maxDelay", "qps", "burst"}
+
+// EnvPrefix is the prefix of the environment variables overriding the settings
+const EnvPrefix = "KONTROLLER"
+
+// EnvName returns the environment variable overriding the setting of the key, e.g.
+// KONTROLLER_MANAGER_THREADNUMBER for manager.threadNumber or KONTROLLER_CONTROLLERS_PVC_CLEANER_WORKERS
+// for controllers.pvc-cleaner.workers
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// envKey returns the key of the log prefix or controller setting overridden by the environment variable,
+// the inverse of EnvName. The '_' of the prefix and controller names stand for '-'.
+func envKey(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, EnvPrefix+"_")
+	if !ok {
+		return "", false
+	}
+	if prefix, ok := strings.CutPrefix(rest, "LOG_PREFIXES_"); ok && prefix != "" {
+		return "log.prefixes." + envName(prefix), true
+	}
+	if rest, ok = strings.CutPrefix(rest, "CONTROLLERS_"); !ok {
+		return "", false
+	}
+	if controller, setting, ok := strings.Cut(rest, "_SETTINGS_"); ok && controller != "" && setting != "" {
+		return "controllers." + envName(controller) + ".settings." + strings.ToLower(setting), true
+	}
+	keys := append([]string{}, controllerKeys...)
+	for _, rateLimiterKey := range rateLimiterKeys {
+		keys = append(keys, "rateLimiter."+rateLimiterKey)
+	}
+	for _, key := range keys {
+		if controller, ok := strings.CutSuffix(rest, strings.TrimPrefix(EnvName(key), EnvPrefix)); ok && controller != "" {
+			return "controllers." + envName(controller) + "." + key, true
+		}
+	}
+	return "", false
+}
+
+// envName returns the prefix or controller name written in an environment variable
+func envName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// AddFlags adds a flag overriding every setting to the flag set, named after its key, e.g. --manager.threadNumber,
+// and the --set flag overriding any setting, including the log prefixes and the controller settings
+func AddFlags(flags *pflag.FlagSet) {
+	flags.StringArray("set", nil, "sets a setting as key=value, e.g. controllers.pvc-cleaner.workers=2 or log.prefixes.reloader=5, overriding the flags, the environment variables and the config file")
+	for _, d := range defaults {
+		usage := fmt.Sprintf("sets %s, overriding the %s environment variable and the config file", d.key, EnvName(d.key))
+		switch value := d.value.(type) {
+		case bool:
+			flags.Bool(d.key, value, usage)
+		case int:
+			flags.Int(d.key, value, usage)
+		case float64:
+			flags.Float64(d.key, value, usage)
+		case string:
+			flags.String(d.key, value, usage)
+		case time.Duration:
+			// A string flag accepts both durations and plain numbers of seconds
+			flags.String(d.key, value.String(), usage)
+		}
+	}
+}
+
+// newDefaults returns a viper instance holding the default values
+func newDefaults() *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	for _, d := range defaults {
+		v.SetDefault(d.key, d.value)
+	}
+	return v
+}
+
+// newViper returns a viper instance holding the default values, overridden by the environment variables
+func newViper() *viper.Viper {
+	v := newDefaults()
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	// The log prefixes and controllers are not known in advance, so their variables are looked up
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if key, ok := envKey(name); ok {
+			v.Set(key, value)
+		}
+	}
+	return v
+}
+
+// Default returns the default configuration, ignoring the environment variables
+func Default() Config {
+	cfg, err := parse(newDefaults())
 	if err != nil {
-		panic(fmt.Errorf("read config err with: %s", err))
+		panic(fmt.Errorf("default config invalid: %v", err))
 	}
-	// Unmarshal the configuration into the Cfg variable
-	err = viper.Unmarshal(&Cfg)
+	return cfg
+}
+
+// Load reads and validates the config file at the path. If the path is empty, config.yaml is searched
+// in ./config, ../config, . and .., falling back to the defaults if none is found.
+// Settings are overridden by the --set flag and the changed flags added by AddFlags, if flags is not nil,
+// then by the KONTROLLER_* environment variables, then by the config file.
+// All invalid settings, unknown keys and bad durations are reported in the returned error.
+func Load(path string, flags *pflag.FlagSet) (Config, error) {
+	v, err := read(path, flags)
+	if err != nil {
+		return Config{}, err
+	}
+	return parse(v)
+}
+
+// read returns a viper instance holding the config file at the path, or the searched config file,
+// overridden by the flags
+func read(path string, flags *pflag.FlagSet) (*viper.Viper, error) {
+	v := newViper()
+	if flags != nil {
+		for _, d := range defaults {
+			if flag := flags.Lookup(d.key); flag != nil {
+				if err := v.BindPFlag(d.key, flag); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if flag := flags.Lookup("set"); flag != nil {
+			values, err := flags.GetStringArray("set")
+			if err != nil {
+				return nil, err
+			}
+			for _, setting := range values {
+				key, value, ok := strings.Cut(setting, "=")
+				if !ok || key == "" {
+					return nil, fmt.Errorf("--set must be key=value, got %q", setting)
+				}
+				v.Set(key, value)
+			}
+		}
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath("./config")
+		v.AddConfigPath("../config")
+		v.AddConfigPath(".")
+		v.AddConfigPath("..")
+	}
+	err := v.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); err != nil && !(ok && path == "") {
+		return nil, fmt.Errorf("read config err with: %s", err)
+	}
+	return v, nil
+}
+
+// parse checks the keys and durations held by viper, then decodes and validates the configuration
+func parse(v *viper.Viper) (Config, error) {
+	var errs []error
+	for _, key := range v.AllKeys() {
+		if !knownKey(key) {
+			errs = append(errs, fmt.Errorf("unknown key %s", key))
+		}
+	}
+	keys := append([]string{}, durationKeys...)
+	names := map[string]bool{}
+	for _, key := range v.AllKeys() {
+		if parts := strings.Split(key, "."); len(parts) > 2 && parts[0] == "controllers" {
+			names[parts[1]] = true
+		}
+	}
+	for name := range names {
+		keys = append(keys, "controllers."+name+".reSyncPeriod", "controllers."+name+".reconcileTimeout",
+			"controllers."+name+".rateLimiter.baseDelay", "controllers."+name+".rateLimiter.maxDelay")
+	}
+	for _, key := range keys {
+		if value := v.Get(key); value != nil {
+			if _, err := parseDuration(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a duration like 30s or 5m, or a number of seconds, got %q", key, fmt.Sprint(value)))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+	cfg, err := decode(v)
 	if err != nil {
-		panic(fmt.Errorf("decode config err with: %s", err))
+		return Config{}, err
+	}
+	if err := Validate(cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// knownKey reports whether the lower case key, as returned by viper, is a configuration setting
+func knownKey(key string) bool {
+	for _, d := range defaults {
+		if key == strings.ToLower(d.key) {
+			return true
+		}
+	}
+	if key == "log.prefixes" || strings.HasPrefix(key, "log.prefixes.") || key == "controllers" {
+		return true
+	}
+	parts := strings.SplitN(key, ".", 3)
+	if parts[0] != "controllers" {
+		return false
+	}
+	if len(parts) == 2 {
+		return true
+	}
+	for _, controllerKey := range controllerKeys {
+		if field := strings.ToLower(controllerKey); parts[2] == field || (field == "settings" && strings.HasPrefix(parts[2], field+".")) {
+			return true
+		}
+	}
+	for _, rateLimiterKey := range rateLimiterKeys {
+		if parts[2] == "ratelimiter."+strings.ToLower(rateLimiterKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// decode unmarshals the configuration held by viper
+func decode(v *viper.Viper) (Config, error) {
+	var cfg Config
+	if err := v.Unmarshal(&cfg, viper.DecodeHook(durationHook)); err != nil {
+		return cfg, fmt.Errorf("decode config err with: %s", err)
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// durationHook decodes the durations with parseDuration
+func durationHook(_ reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != durationType {
+		return data, nil
+	}
+	return parseDuration(data)
+}
+
+// parseDuration parses a duration like "30s", "5m" or "1h". Plain numbers, as for the
+// integers of former config files, are seconds.
+func parseDuration(value interface{}) (time.Duration, error) {
+	switch value := value.(type) {
+	case time.Duration:
+		return value, nil
+	case string:
+		value = strings.TrimSpace(value)
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+		return time.ParseDuration(value)
+	case bool:
+		return 0, fmt.Errorf("invalid duration %v", value)
+	}
+	seconds, err := cast.ToFloat64E(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %v", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Validate returns the errors of the invalid settings of the configuration
+func Validate(cfg Config) error {
+	var errs []error
+	if cfg.Log.Level < 1 || cfg.Log.Level > 5 {
+		errs = append(errs, fmt.Errorf("log.level must be between 1 and 5, got %d", cfg.Log.Level))
+	}
+	if format := strings.ToLower(cfg.Log.Format); format != "text" && format != "json" {
+		errs = append(errs, fmt.Errorf("log.format must be text or json, got %q", cfg.Log.Format))
+	}
+	for prefix, level := range cfg.Log.Prefixes {
+		if level < 1 || level > 5 {
+			errs = append(errs, fmt.Errorf("log.prefixes.%s must be between 1 and 5, got %d", prefix, level))
+		}
+	}
+	if cfg.Manager.ThreadNumber < 1 {
+		errs = append(errs, fmt.Errorf("manager.threadNumber must be at least 1, got %d", cfg.Manager.ThreadNumber))
+	}
+	if cfg.Manager.ControllerMaxRetryTimes < 0 {
+		errs = append(errs, fmt.Errorf("manager.controllerMaxRetryTimes must not be negative, got %d", cfg.Manager.ControllerMaxRetryTimes))
+	}
+	if cfg.Manager.ThreadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("manager.threadTimeout must be positive, got %s", cfg.Manager.ThreadTimeout))
+	}
+	if cfg.Manager.ReSyncPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("manager.reSyncPeriod must be positive, got %s", cfg.Manager.ReSyncPeriod))
+	}
+	if cfg.Manager.ReconcileTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("manager.reconcileTimeout must be positive, got %s", cfg.Manager.ReconcileTimeout))
+	}
+	if cfg.Manager.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("manager.shutdownTimeout must not be negative, got %s", cfg.Manager.ShutdownTimeout))
+	}
+	if cfg.Manager.LivenessThreshold <= 0 {
+		errs = append(errs, fmt.Errorf("manager.livenessThreshold must be positive, got %s", cfg.Manager.LivenessThreshold))
+	}
+	if election := cfg.Manager.LeaderElection; election.Enabled {
+		if election.LeaseName == "" || election.LeaseNamespace == "" {
+			errs = append(errs, fmt.Errorf("manager.leaderElection.leaseName and leaseNamespace must be set"))
+		}
+		if election.RetryPeriod <= 0 || election.RenewDeadline <= election.RetryPeriod || election.LeaseDuration <= election.RenewDeadline {
+			errs = append(errs, fmt.Errorf("manager.leaderElection durations must satisfy leaseDuration > renewDeadline > retryPeriod > 0"))
+		}
+	}
+	errs = append(errs, validateRateLimiter("manager.rateLimiter", cfg.Manager.RateLimiter)...)
+	for name, controller := range cfg.Controllers {
+		if controller.RateLimiter != (RateLimiter{}) {
+			errs = append(errs, validateRateLimiter("controllers."+name+".rateLimiter", cfg.ControllerSettings(name).RateLimiter)...)
+		}
+		if controller.Workers < 0 {
+			errs = append(errs, fmt.Errorf("controllers.%s.workers must not be negative, got %d", name, controller.Workers))
+		}
+		if controller.MaxRetries != nil && *controller.MaxRetries < 0 {
+			errs = append(errs, fmt.Errorf("controllers.%s.maxRetries must not be negative, got %d", name, *controller.MaxRetries))
+		}
+		if controller.ReSyncPeriod != nil && *controller.ReSyncPeriod <= 0 {
+			errs = append(errs, fmt.Errorf("controllers.%s.reSyncPeriod must be positive, got %s", name, *controller.ReSyncPeriod))
+		}
+		if controller.ReconcileTimeout != nil && *controller.ReconcileTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("controllers.%s.reconcileTimeout must be positive, got %s", name, *controller.ReconcileTimeout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateRateLimiter returns the errors of the invalid rate limiter settings, prefixed with their key
+func validateRateLimiter(key string, r RateLimiter) []error {
+	var errs []error
+	switch strings.ToLower(r.Type) {
+	case RateLimiterExponential, RateLimiterBucket, RateLimiterMax:
+	default:
+		errs = append(errs, fmt.Errorf("%s.type must be %s, %s or %s, got %q", key, RateLimiterExponential, RateLimiterBucket, RateLimiterMax, r.Type))
+	}
+	if r.BaseDelay <= 0 || r.MaxDelay < r.BaseDelay {
+		errs = append(errs, fmt.Errorf("%s delays must satisfy maxDelay >= baseDelay > 0, got %s and %s", key, r.MaxDelay, r.BaseDelay))
+	}
+	if r.QPS <= 0 {
+		errs = append(errs, fmt.Errorf("%s.qps must be positive, got %v", key, r.QPS))
+	}
+	if r.Burst < 1 {
+		errs = append(errs, fmt.Errorf("%s.burst must be at least 1, got %d", key, r.Burst))
+	}
+	return errs
+}
+
+// RestartRequired returns the changed settings which are not applied live and need a restart
+func RestartRequired(old, cfg Config) []string {
+	var settings []string
+	if old.Manager.ThreadTimeout != cfg.Manager.ThreadTimeout {
+		settings = append(settings, "manager.threadTimeout")
+	}
+	if old.Manager.ReSyncPeriod != cfg.Manager.ReSyncPeriod {
+		settings = append(settings, "manager.reSyncPeriod")
+	}
+	if old.Manager.ShutdownTimeout != cfg.Manager.ShutdownTimeout {
+		settings = append(settings, "manager.shutdownTimeout")
+	}
+	if old.Manager.MetricsAddress != cfg.Manager.MetricsAddress {
+		settings = append(settings, "manager.metricsAddress")
+	}
+	if old.Manager.HealthProbeAddress != cfg.Manager.HealthProbeAddress {
+		settings = append(settings, "manager.healthProbeAddress")
+	}
+	if old.Manager.AdminAddress != cfg.Manager.AdminAddress {
+		settings = append(settings, "manager.adminAddress")
+	}
+	if old.Manager.LivenessThreshold != cfg.Manager.LivenessThreshold {
+		settings = append(settings, "manager.livenessThreshold")
+	}
+	if old.Manager.LeaderElection != cfg.Manager.LeaderElection {
+		settings = append(settings, "manager.leaderElection")
+	}
+	names := map[string]bool{}
+	for name := range old.Controllers {
+		names[name] = true
+	}
+	for name := range cfg.Controllers {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		before, after := old.ControllerSettings(name), cfg.ControllerSettings(name)
+		if before.Enabled != after.Enabled {
+			settings = append(settings, "controllers."+name+".enabled")
+		}
+		if !equalDuration(old.Controllers[name].ReSyncPeriod, cfg.Controllers[name].ReSyncPeriod) {
+			settings = append(settings, "controllers."+name+".reSyncPeriod")
+		}
+		if !equalString(before.Namespace, after.Namespace) {
+			settings = append(settings, "controllers."+name+".namespace")
+		}
+		if !equalString(before.LabelSelector, after.LabelSelector) {
+			settings = append(settings, "controllers."+name+".labelSelector")
+		}
+		if !reflect.DeepEqual(before.Settings, after.Settings) {
+			settings = append(settings, "controllers."+name+".settings")
+		}
+	}
+	return settings
+}
+
+// equalDuration reports whether both durations are unset or equal
+func equalDuration(a, b *time.Duration) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// equalString reports whether both strings are unset or equal
+func equalString(a, b *string) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   []*func(old, cfg Config)
+)
+
+// OnChange registers a function called with the previous and the new configuration
+// when the configuration is set or a valid change of the config file is loaded.
+// The returned function removes it.
+func OnChange(fn func(old, cfg Config)) (remove func()) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listener := &fn
+	listeners = append(listeners, listener)
+	return func() {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		for i, l := range listeners {
+			if l == listener {
+				listeners = append(listeners[:i:i], listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Set replaces Cfg with the loaded configuration at startup, before the controllers run,
+// and notifies the OnChange functions
+func Set(cfg Config) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	old := Cfg
+	Cfg = cfg
+	for _, fn := range listeners {
+		(*fn)(old, cfg)
+	}
+}
+
+// Watch watches the config file at the path, or the searched config file, in the background
+// and reloads it on changes, keeping the overrides of the flags and environment variables.
+// Invalid changes are rejected and passed to onError. It does nothing if no config file was found.
+func Watch(path string, flags *pflag.FlagSet, onError func(error)) {
+	v, err := read(path, flags)
+	if err != nil || v.ConfigFileUsed() == "" {
+		return
+	}
+	current := Cfg
+	v.OnConfigChange(func(fsnotify.Event) {
+		if err := reload(v, &current); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+	v.WatchConfig()
+}
+
+// reload parses and validates the configuration held by viper again, then notifies the OnChange functions
+// with the current and the new configuration. Cfg keeps the configuration set at startup, as it is read
+// without synchronization; the live settings are applied by the OnChange functions.
+func reload(v *viper.Viper, current *Config) error {
+	cfg, err := parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	old := *current
+	*current = cfg
+	for _, fn := range listeners {
+		(*fn)(old, cfg)
 	}
-	// Convert time.Duration settings from seconds to actual duration
-	Cfg.Manager.ThreadTimeout *= time.Second
-	Cfg.Manager.ReSyncPeriod *= time.Second
+	return nil
 }
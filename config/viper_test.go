@@ -1,7 +1,9 @@
 package config
 
 import (
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,3 +54,328 @@ func TestManager(t *testing.T) {
 		t.Errorf("Thread number is incorrect, got: %d, want: %d.", manager.ThreadNumber, -1)
 	}
 }
+func TestReload(t *testing.T) {
+	var got Config
+	remove := OnChange(func(_, cfg Config) { got = cfg })
+	defer remove()
+	v := newViper()
+	v.Set("log.level", 5)
+	current := Cfg
+	if err := reload(v, &current); err != nil {
+		t.Fatalf("reload failed with err: %v", err)
+	}
+	if got.Log.Level != 5 {
+		t.Errorf("Notified log level is incorrect, got: %d, want: %d.", got.Log.Level, 5)
+	}
+	if Cfg.Log.Level == 5 {
+		t.Errorf("Reload changed the startup config.")
+	}
+	if current.Log.Level != 5 {
+		t.Errorf("Current log level is incorrect, got: %d, want: %d.", current.Log.Level, 5)
+	}
+	if got.Manager.ThreadTimeout != Cfg.Manager.ThreadTimeout {
+		t.Errorf("Thread timeout is incorrect, got: %v, want: %v.", got.Manager.ThreadTimeout, Cfg.Manager.ThreadTimeout)
+	}
+}
+func TestReload_Invalid(t *testing.T) {
+	notified := false
+	remove := OnChange(func(_, _ Config) { notified = true })
+	defer remove()
+	v := newViper()
+	v.Set("manager.threadNumber", 0)
+	current := Cfg
+	if err := reload(v, &current); err == nil {
+		t.Errorf("Expected error when reloading an invalid config, but got no error.")
+	}
+	if notified {
+		t.Errorf("Invalid config is notified.")
+	}
+}
+func TestOnChange_Remove(t *testing.T) {
+	calls := 0
+	remove := OnChange(func(_, _ Config) { calls++ })
+	Set(Cfg)
+	remove()
+	Set(Cfg)
+	if calls != 1 {
+		t.Errorf("Listener calls are incorrect, got: %d, want: %d.", calls, 1)
+	}
+}
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/valid.yaml", nil)
+	if err != nil {
+		t.Fatalf("Load failed with err: %v", err)
+	}
+	if cfg.Manager.ThreadNumber != 3 {
+		t.Errorf("Thread number is incorrect, got: %d, want: %d.", cfg.Manager.ThreadNumber, 3)
+	}
+	if cfg.Manager.ReSyncPeriod != 60*time.Second {
+		t.Errorf("Re-sync period is incorrect, got: %v, want: %v.", cfg.Manager.ReSyncPeriod, 60*time.Second)
+	}
+	if cfg.Manager.ShutdownTimeout != 30*time.Second {
+		t.Errorf("Shutdown timeout default is incorrect, got: %v, want: %v.", cfg.Manager.ShutdownTimeout, 30*time.Second)
+	}
+	if period := cfg.ControllerSettings("pvc-cleaner").ReSyncPeriod; period != 120*time.Second {
+		t.Errorf("Controller re-sync period is incorrect, got: %v, want: %v.", period, 120*time.Second)
+	}
+	if cfg.ControllerSettings("pvc-cleaner").Settings["graceperiod"] != "10m" {
+		t.Errorf("Controller setting is incorrect, got: %q, want: %q.", cfg.ControllerSettings("pvc-cleaner").Settings["graceperiod"], "10m")
+	}
+	want := RateLimiter{Type: RateLimiterExponential, BaseDelay: time.Second, MaxDelay: 1000 * time.Second, QPS: 10, Burst: 100}
+	if limiter := cfg.ControllerSettings("pvc-cleaner").RateLimiter; limiter != want {
+		t.Errorf("Controller rate limiter is incorrect, got: %+v, want: %+v.", limiter, want)
+	}
+	want = RateLimiter{Type: RateLimiterMax, BaseDelay: 5 * time.Millisecond, MaxDelay: 1000 * time.Second, QPS: 0.5, Burst: 1}
+	if limiter := cfg.ControllerSettings("reloader").RateLimiter; limiter != want {
+		t.Errorf("Controller rate limiter is incorrect, got: %+v, want: %+v.", limiter, want)
+	}
+}
+func TestLoad_Invalid(t *testing.T) {
+	_, err := Load("testdata/invalid.yaml", nil)
+	if err == nil {
+		t.Fatalf("Expected error when loading an invalid config, but got no error.")
+	}
+	for _, want := range []string{"unknown key manager.threadnumbr", "unknown key controllers.reloader.workerz", "unknown key controllers.reloader.ratelimiter.qpz", "manager.threadTimeout must be a duration"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error does not report %q, got: %v.", want, err)
+		}
+	}
+	_, err = Load("testdata/out-of-range.yaml", nil)
+	if err == nil {
+		t.Fatalf("Expected error when loading an out of range config, but got no error.")
+	}
+	for _, want := range []string{"log.level", "manager.threadNumber", "manager.reSyncPeriod", "manager.rateLimiter.type", "controllers.reloader.rateLimiter.burst"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error does not report %q, got: %v.", want, err)
+		}
+	}
+	if _, err := Load("testdata/missing.yaml", nil); err == nil {
+		t.Errorf("Expected error when loading a missing config, but got no error.")
+	}
+}
+func TestLoad_Repository(t *testing.T) {
+	if _, err := Load("config.yaml", nil); err != nil {
+		t.Errorf("Repository config is invalid with err: %v", err)
+	}
+}
+func TestValidate(t *testing.T) {
+	if err := Validate(Cfg); err != nil {
+		t.Errorf("Default config is invalid with err: %v", err)
+	}
+	cfg := Cfg
+	cfg.Log.Level = 7
+	cfg.Manager.ThreadNumber = 0
+	err := Validate(cfg)
+	if err == nil {
+		t.Fatalf("Expected error when validating an invalid config, but got no error.")
+	}
+	if got := len(strings.Split(err.Error(), "\n")); got != 2 {
+		t.Errorf("Error count is incorrect, got: %d, want: %d.", got, 2)
+	}
+}
+func TestRestartRequired(t *testing.T) {
+	cfg := Cfg
+	cfg.Manager.ThreadNumber++
+	cfg.Manager.ControllerMaxRetryTimes++
+	cfg.Log.Level = 5
+	if settings := RestartRequired(Cfg, cfg); len(settings) != 0 {
+		t.Errorf("Live settings require restart: %v", settings)
+	}
+	cfg.Manager.ReSyncPeriod += time.Second
+	cfg.Manager.LeaderElection.Enabled = !cfg.Manager.LeaderElection.Enabled
+	settings := RestartRequired(Cfg, cfg)
+	if want := []string{"manager.reSyncPeriod", "manager.leaderElection"}; strings.Join(settings, ",") != strings.Join(want, ",") {
+		t.Errorf("Restart required settings are incorrect, got: %v, want: %v.", settings, want)
+	}
+}
+func TestControllerSettings(t *testing.T) {
+	disabled, maxRetries, period, namespace := false, int32(0), 60*time.Second, "default"
+	cfg := Config{
+		Manager: Manager{ThreadNumber: 2, ControllerMaxRetryTimes: 5, ReSyncPeriod: 300 * time.Second},
+		Controllers: map[string]Controller{
+			"pvc-cleaner": {Workers: 4, MaxRetries: &maxRetries, ReSyncPeriod: &period, Namespace: &namespace, Settings: map[string]string{"GracePeriod": "10m"}},
+			"reloader":    {Enabled: &disabled},
+		},
+	}
+	settings := cfg.ControllerSettings("pvc-cleaner")
+	if !settings.Enabled || settings.Workers != 4 || settings.MaxRetries != 0 || settings.ReSyncPeriod != period {
+		t.Errorf("Controller settings are incorrect, got: %+v.", settings)
+	}
+	if settings.Namespace == nil || *settings.Namespace != namespace || settings.LabelSelector != nil {
+		t.Errorf("Controller selection settings are incorrect, got: %+v.", settings)
+	}
+	if settings.Settings["graceperiod"] != "10m" {
+		t.Errorf("Controller specific setting is incorrect, got: %q, want: %q.", settings.Settings["graceperiod"], "10m")
+	}
+	if cfg.ControllerSettings("reloader").Enabled {
+		t.Errorf("Disabled controller is enabled.")
+	}
+	fallback := cfg.ControllerSettings("sts-pod-service")
+	if !fallback.Enabled || fallback.Workers != 2 || fallback.MaxRetries != 5 || fallback.ReSyncPeriod != 300*time.Second {
+		t.Errorf("Fallback controller settings are incorrect, got: %+v.", fallback)
+	}
+}
+func TestLoad_Overrides(t *testing.T) {
+	t.Setenv("KONTROLLER_MANAGER_THREADNUMBER", "4")
+	t.Setenv("KONTROLLER_MANAGER_METRICSADDRESS", ":9191")
+	t.Setenv("KONTROLLER_LOG_FORMAT", "json")
+	t.Setenv("KONTROLLER_MANAGER_RATELIMITER_TYPE", "bucket")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddFlags(flags)
+	if err := flags.Parse([]string{"--manager.threadNumber=5", "--manager.leaderElection.enabled", "--manager.shutdownTimeout=1m", "--manager.rateLimiter.qps=2.5"}); err != nil {
+		t.Fatalf("Parse failed with err: %v", err)
+	}
+	cfg, err := Load("testdata/valid.yaml", flags)
+	if err != nil {
+		t.Fatalf("Load failed with err: %v", err)
+	}
+	// flag > env > file > default
+	if cfg.Manager.ThreadNumber != 5 {
+		t.Errorf("Thread number is incorrect, got: %d, want: %d.", cfg.Manager.ThreadNumber, 5)
+	}
+	if cfg.Manager.MetricsAddress != ":9191" {
+		t.Errorf("Metrics address is incorrect, got: %s, want: %s.", cfg.Manager.MetricsAddress, ":9191")
+	}
+	if cfg.Log.Format != "json" {
+		t.Errorf("Log format is incorrect, got: %s, want: %s.", cfg.Log.Format, "json")
+	}
+	if !cfg.Manager.LeaderElection.Enabled {
+		t.Errorf("Leader election is not enabled by the flag.")
+	}
+	if cfg.Manager.ReSyncPeriod != 60*time.Second {
+		t.Errorf("Re-sync period is incorrect, got: %v, want: %v.", cfg.Manager.ReSyncPeriod, 60*time.Second)
+	}
+	if cfg.Manager.ShutdownTimeout != time.Minute {
+		t.Errorf("Shutdown timeout is incorrect, got: %v, want: %v.", cfg.Manager.ShutdownTimeout, time.Minute)
+	}
+	if cfg.Manager.ThreadTimeout != 5*time.Second {
+		t.Errorf("Thread timeout default is incorrect, got: %v, want: %v.", cfg.Manager.ThreadTimeout, 5*time.Second)
+	}
+	if limiter := cfg.Manager.RateLimiter; limiter.Type != RateLimiterBucket || limiter.QPS != 2.5 {
+		t.Errorf("Rate limiter is incorrect, got: %+v, want type %s and qps %v.", limiter, RateLimiterBucket, 2.5)
+	}
+}
+func TestLoad_MapOverrides(t *testing.T) {
+	t.Setenv("KONTROLLER_CONTROLLERS_PVC_CLEANER_WORKERS", "7")
+	t.Setenv("KONTROLLER_CONTROLLERS_PVC_CLEANER_SETTINGS_GRACEPERIOD", "1m")
+	t.Setenv("KONTROLLER_CONTROLLERS_RELOADER_RATELIMITER_QPS", "0.2")
+	t.Setenv("KONTROLLER_LOG_PREFIXES_PVC_CLEANER", "5")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddFlags(flags)
+	if err := flags.Parse([]string{"--set=controllers.pvc-cleaner.workers=8", "--set", "controllers.sts-pod-service.enabled=false"}); err != nil {
+		t.Fatalf("Parse failed with err: %v", err)
+	}
+	cfg, err := Load("testdata/valid.yaml", flags)
+	if err != nil {
+		t.Fatalf("Load failed with err: %v", err)
+	}
+	settings := cfg.ControllerSettings("pvc-cleaner")
+	// --set > env > file
+	if settings.Workers != 8 {
+		t.Errorf("Controller workers are incorrect, got: %d, want: %d.", settings.Workers, 8)
+	}
+	if settings.Settings["graceperiod"] != "1m" || settings.ReSyncPeriod != 120*time.Second {
+		t.Errorf("Controller settings are incorrect, got: %+v.", settings)
+	}
+	if qps := cfg.ControllerSettings("reloader").RateLimiter.QPS; qps != 0.2 {
+		t.Errorf("Controller rate limiter qps is incorrect, got: %v, want: %v.", qps, 0.2)
+	}
+	if cfg.ControllerSettings("sts-pod-service").Enabled {
+		t.Errorf("Controller is not disabled by the flag.")
+	}
+	if cfg.Log.Prefixes["pvc-cleaner"] != 5 || cfg.Log.Prefixes["reloader"] != 5 {
+		t.Errorf("Log prefixes are incorrect, got: %v.", cfg.Log.Prefixes)
+	}
+	if err := flags.Parse([]string{"--set=controllers.pvc-cleaner.workerz=1"}); err != nil {
+		t.Fatalf("Parse failed with err: %v", err)
+	}
+	if _, err := Load("testdata/valid.yaml", flags); err == nil || !strings.Contains(err.Error(), "unknown key controllers.pvc-cleaner.workerz") {
+		t.Errorf("Expected unknown key error for the flag, got: %v.", err)
+	}
+}
+func TestDefault_IgnoresEnv(t *testing.T) {
+	t.Setenv("KONTROLLER_MANAGER_THREADNUMBER", "0")
+	t.Setenv("KONTROLLER_CONTROLLERS_RELOADER_WORKERS", "-1")
+	if cfg := Default(); cfg.Manager.ThreadNumber != 1 || len(cfg.Controllers) != 0 {
+		t.Errorf("Default config is overridden by the environment, got: %+v.", cfg)
+	}
+}
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"KONTROLLER_LOG_PREFIXES_PVC_CLEANER", "log.prefixes.pvc-cleaner", true},
+		{"KONTROLLER_CONTROLLERS_PVC_CLEANER_WORKERS", "controllers.pvc-cleaner.workers", true},
+		{"KONTROLLER_CONTROLLERS_RELOADER_RESYNCPERIOD", "controllers.reloader.reSyncPeriod", true},
+		{"KONTROLLER_CONTROLLERS_SECRET_RELOADER_RATELIMITER_BURST", "controllers.secret-reloader.rateLimiter.burst", true},
+		{"KONTROLLER_CONTROLLERS_STS_POD_SERVICE_SETTINGS_SERVICETYPE", "controllers.sts-pod-service.settings.servicetype", true},
+		{"KONTROLLER_MANAGER_THREADNUMBER", "", false},
+		{"KONTROLLER_SERVICE_HOST", "", false},
+		{"KONTROLLER_CONTROLLERS_WORKERS", "", false},
+	}
+	for _, test := range tests {
+		if key, ok := envKey(test.name); key != test.key || ok != test.ok {
+			t.Errorf("Key of %s is incorrect, got: %q, %v, want: %q, %v.", test.name, key, ok, test.key, test.ok)
+		}
+	}
+	if got := EnvName("controllers.pvc-cleaner.workers"); got != "KONTROLLER_CONTROLLERS_PVC_CLEANER_WORKERS" {
+		t.Errorf("Env name is incorrect, got: %s, want: %s.", got, "KONTROLLER_CONTROLLERS_PVC_CLEANER_WORKERS")
+	}
+}
+func TestEnvName(t *testing.T) {
+	if got := EnvName("manager.leaderElection.leaseName"); got != "KONTROLLER_MANAGER_LEADERELECTION_LEASENAME" {
+		t.Errorf("Env name is incorrect, got: %s, want: %s.", got, "KONTROLLER_MANAGER_LEADERELECTION_LEASENAME")
+	}
+}
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"1h", time.Hour},
+		{"1m30s", 90 * time.Second},
+		{300, 300 * time.Second},
+		{"300", 300 * time.Second},
+		{1.5, 1500 * time.Millisecond},
+		{2 * time.Second, 2 * time.Second},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.value)
+		if err != nil {
+			t.Errorf("parseDuration(%v) failed with err: %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Duration of %v is incorrect, got: %v, want: %v.", test.value, got, test.want)
+		}
+	}
+	for _, value := range []interface{}{"soon", "5 minutes", true} {
+		if _, err := parseDuration(value); err == nil {
+			t.Errorf("Expected error when parsing %v, but got no error.", value)
+		}
+	}
+}
+func TestLoad_Durations(t *testing.T) {
+	// Plain integers of former config files keep meaning seconds, and are not scaled twice.
+	cfg, err := Load("testdata/durations.yaml", nil)
+	if err != nil {
+		t.Fatalf("Load failed with err: %v", err)
+	}
+	want := map[string][2]time.Duration{
+		"threadTimeout":     {cfg.Manager.ThreadTimeout, 3 * time.Second},
+		"reSyncPeriod":      {cfg.Manager.ReSyncPeriod, 5 * time.Minute},
+		"shutdownTimeout":   {cfg.Manager.ShutdownTimeout, 45 * time.Second},
+		"livenessThreshold": {cfg.Manager.LivenessThreshold, time.Hour},
+		"leaseDuration":     {cfg.Manager.LeaderElection.LeaseDuration, 15 * time.Second},
+		"controller":        {cfg.ControllerSettings("pvc-cleaner").ReSyncPeriod, 90 * time.Second},
+	}
+	for name, durations := range want {
+		if durations[0] != durations[1] {
+			t.Errorf("%s is incorrect, got: %v, want: %v.", name, durations[0], durations[1])
+		}
+	}
+}
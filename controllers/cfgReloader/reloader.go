@@ -1,19 +1,50 @@
 package cfgReloader
 
 import (
+	"Kontroller/config"
 	"Kontroller/logging"
+	"Kontroller/pkg/api"
 	"Kontroller/pkg/common"
+	"Kontroller/pkg/utils"
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var log *logging.Logging
 
 const (
 	ReloaderName         = "reloader"
+	SecretReloaderName   = "secret-reloader"
 	DefaultLabelSelector = "kontroller/reloader=true"
+	ConfigHashAnnotation = "kontroller/config-hash"
+	// DefaultOptInSyncPeriod is the default delay of reloading an unlabelled config a workload opts in to.
+	DefaultOptInSyncPeriod = time.Minute
+)
+
+// Workload annotations controlling the reload behavior.
+const (
+	// ReloadConfigMapsAnnotation lists the comma separated configmaps that restart the workload.
+	ReloadConfigMapsAnnotation = "kontroller/reload-configmaps"
+	// ReloadSecretsAnnotation lists the comma separated secrets that restart the workload.
+	ReloadSecretsAnnotation = "kontroller/reload-secrets"
+	// AutoReloadAnnotation set to "true" restarts the workload on changes of every config it consumes.
+	AutoReloadAnnotation = "kontroller/auto-reload"
+	// ReloadAnnotation set to "false" opts the workload out of any reload.
+	ReloadAnnotation = "kontroller/reload"
 )
 
 func init() {
@@ -26,8 +57,27 @@ type Reloader struct {
 	Object        runtime.Object
 	Namespace     string
 	LabelSelector string
+	// RestartLimiter throttles the workload restarts shared by all workers, nil for no limit.
+	RestartLimiter *rate.Limiter
+	// OptInSyncPeriod is the resync period of the workload informers, picking up changes of the unlabelled
+	// configs the workloads opt in to.
+	OptInSyncPeriod time.Duration
+	// workloads are the caches of the workload informers, indexed by configIndex.
+	workloads []cache.Indexer
+}
+
+// configKind describes how workloads follow the configs of a kind.
+type configKind struct {
+	name           string
+	listAnnotation string
+	names          func(spec *corev1.PodSpec) []string
 }
 
+var (
+	configMapKind = configKind{name: "configmap", listAnnotation: ReloadConfigMapsAnnotation, names: configMapNames}
+	secretKind    = configKind{name: "secret", listAnnotation: ReloadSecretsAnnotation, names: secretNames}
+)
+
 func (r *Reloader) ControllerName() string {
 	return r.Name
 }
@@ -44,15 +94,240 @@ func (r *Reloader) ControlNamespace() string {
 	return r.Namespace
 }
 
+// ControlLabelSelector selects the labelled configs. The unlabelled configs workloads opt in to are
+// enqueued by the workload informers, see Watch.
 func (r *Reloader) ControlLabelSelector() string {
 	return r.LabelSelector
 }
 
-func (r *Reloader) HandleObject(client *kubernetes.Clientset, object interface{}) error {
-	configmaps := object.(*corev1.ConfigMap)
-	log.Infof("configmap %s/%s changed", configmaps.Namespace, configmaps.Name)
-	//TODO: your logic here
-	return nil
+// Watch returns the deployment, statefulSet and daemonSet informers. Their caches are indexed by the configs
+// the workloads consume or list. The configs of the reloader's kind a new or changed workload consumes are added
+// to the queue to record their hash, and every OptInSyncPeriod the configs it opts in to, as unlabelled configs
+// are not watched. The resync period of the controller is used if OptInSyncPeriod is not set.
+func (r *Reloader) Watch(client kubernetes.Interface, queue workqueue.RateLimitingInterface, resyncPeriod time.Duration) []cache.Controller {
+	if r.OptInSyncPeriod > 0 {
+		resyncPeriod = r.OptInSyncPeriod
+	}
+	kind := r.kind()
+	// enqueue adds the configs the workload opts in to, and every config it consumes if consumed is set.
+	enqueue := func(obj interface{}, consumed bool) {
+		w := toWorkload(obj)
+		if w == nil || w.Annotations[ReloadAnnotation] == "false" {
+			return
+		}
+		names := listed(w, kind)
+		if consumed || w.Annotations[AutoReloadAnnotation] == "true" {
+			names = append(names, kind.names(&w.Template.Spec)...)
+		}
+		for _, name := range names {
+			queue.Add(w.Namespace + "/" + name)
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		// New workloads and changed specs record the hash of every consumed config right away, so that the
+		// next change of a labelled config restarts them.
+		AddFunc: func(obj interface{}) { enqueue(obj, true) },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, cur := oldObj.(metav1.Object), newObj.(metav1.Object)
+			switch {
+			case old.GetGeneration() != cur.GetGeneration() || !reflect.DeepEqual(old.GetAnnotations(), cur.GetAnnotations()):
+				enqueue(newObj, true)
+			case old.GetResourceVersion() == cur.GetResourceVersion():
+				// Resyncs pick up changes of the unlabelled configs the workloads opt in to.
+				enqueue(newObj, false)
+			}
+		},
+	}
+	var informers []cache.Controller
+	r.workloads = nil
+	for obj, lw := range workloadListWatches(client, r.Namespace) {
+		indexer, informer := cache.NewIndexerInformer(lw, obj, resyncPeriod, handler, cache.Indexers{configIndex: configIndexFunc})
+		r.workloads = append(r.workloads, indexer)
+		informers = append(informers, informer)
+	}
+	return informers
+}
+
+// HandleObject restarts the workloads following the configmap or secret, see Reconcile.
+func (r *Reloader) HandleObject(client kubernetes.Interface, object interface{}) error {
+	return r.reload(context.TODO(), client, object)
+}
+
+// Reconcile restarts the workloads in the object's namespace that follow the configmap or secret
+// and recorded a hash of other data. Workloads without a recorded hash only get it recorded, which
+// Watch triggers once they are created. Restarts are throttled by the RestartLimiter. A workload
+// follows a config it consumes if the config matches the label selector or the workload is annotated
+// with auto-reload, and any config listed in its reload-configmaps/reload-secrets annotations.
+// Workloads annotated with reload "false" are never restarted. Configs not in the cache of the
+// labelled ones are fetched, as workloads may opt in to them, and skipped once deleted.
+func (r *Reloader) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	object := req.Object
+	if object == nil {
+		var err error
+		object, err = r.get(ctx, req.Client, req.Namespace, req.Name)
+		if errors.IsNotFound(err) {
+			return api.Result{}, nil
+		}
+		if err != nil {
+			return api.Result{}, err
+		}
+	}
+	return api.Result{}, r.reload(ctx, req.Client, object)
+}
+
+// get fetches the configmap or secret watched by the reloader.
+func (r *Reloader) get(ctx context.Context, client kubernetes.Interface, namespace, name string) (interface{}, error) {
+	if r.Resource == common.Secrets {
+		return client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	return client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// kind returns the kind of the configs watched by the reloader.
+func (r *Reloader) kind() configKind {
+	if r.Resource == common.Secrets {
+		return secretKind
+	}
+	return configMapKind
+}
+
+// reload restarts the workloads following the configmap or secret.
+func (r *Reloader) reload(ctx context.Context, client kubernetes.Interface, object interface{}) error {
+	var kind configKind
+	var meta metav1.Object
+	var hash, legacyHash string
+	var err error
+	switch obj := object.(type) {
+	case *corev1.ConfigMap:
+		kind, meta = configMapKind, obj
+		hash, err = utils.HashCompute(map[string]interface{}{"data": obj.Data, "binaryData": obj.BinaryData})
+	case *corev1.Secret:
+		kind, meta = secretKind, obj
+		hash, legacyHash, err = secretHashes(obj)
+	default:
+		return fmt.Errorf("unexpected object type %T", object)
+	}
+	if err != nil {
+		return err
+	}
+	selector, err := labels.Parse(r.LabelSelector)
+	if err != nil {
+		return err
+	}
+	labelled := selector.Matches(labels.Set(meta.GetLabels()))
+	log.FromContext(ctx).Debugf("%s %s/%s synced with hash %s", kind.name, meta.GetNamespace(), meta.GetName(), hash)
+	workloads, err := r.consumers(kind, meta.GetNamespace(), meta.GetName())
+	if err != nil {
+		return err
+	}
+	key := configHashAnnotation(kind.name, meta.GetName())
+	var errs []error
+	for _, w := range workloads {
+		if !follows(w, meta.GetName(), kind, labelled) {
+			continue
+		}
+		recorded, ok := w.Annotations[key]
+		if !ok {
+			// Stamped by earlier versions on the pod template only.
+			recorded, ok = w.Template.Annotations[key]
+		}
+		if recorded == hash {
+			continue
+		}
+		if ok && legacyHash != "" && recorded == legacyHash {
+			// The data did not change since the unkeyed hash was recorded, replace it without a restart.
+			ok = false
+		}
+		if ok && r.RestartLimiter != nil {
+			if err := r.RestartLimiter.Wait(ctx); err != nil {
+				// The remaining workloads are restarted on retry.
+				errs = append(errs, fmt.Errorf("restart %s throttled: %v", w, err))
+				break
+			}
+		}
+		// A workload seen first, e.g. on install or once created, only gets the hash recorded.
+		if err := patchAnnotations(ctx, client, w, map[string]string{key: hash}, ok); err != nil {
+			errs = append(errs, fmt.Errorf("reload %s failed: %v", w, err))
+			continue
+		}
+		if ok {
+			log.FromContext(ctx).Infof("%s restarted for %s %s changed", w, kind.name, meta.GetName())
+		} else {
+			log.FromContext(ctx).Infof("%s recorded hash of %s %s", w, kind.name, meta.GetName())
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// consumers returns the cached workloads consuming or listing the config.
+func (r *Reloader) consumers(kind configKind, namespace, name string) ([]*workload, error) {
+	if len(r.workloads) == 0 {
+		return nil, fmt.Errorf("workloads of reloader %s are not watched", r.Name)
+	}
+	var workloads []*workload
+	for _, indexer := range r.workloads {
+		objects, err := indexer.ByIndex(configIndex, configIndexKey(kind.name, namespace, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			if w := toWorkload(obj); w != nil {
+				workloads = append(workloads, w)
+			}
+		}
+	}
+	return workloads, nil
+}
+
+// secretHashes returns the hash of the secret data keyed with the secret UID, so that workload readers
+// cannot brute-force the data offline, and the unkeyed hash recorded by earlier versions.
+func secretHashes(secret *corev1.Secret) (string, string, error) {
+	data := map[string]interface{}{"data": secret.Data}
+	hash, err := utils.HMACCompute([]byte(secret.UID), data)
+	if err != nil {
+		return "", "", err
+	}
+	legacyHash, err := utils.HashCompute(data)
+	return hash, legacyHash, err
+}
+
+// follows reports whether the workload should be restarted when the named config changes.
+func follows(w *workload, name string, kind configKind, labelled bool) bool {
+	if w.Annotations[ReloadAnnotation] == "false" {
+		return false
+	}
+	if contains(listed(w, kind), name) {
+		return true
+	}
+	if !labelled && w.Annotations[AutoReloadAnnotation] != "true" {
+		return false
+	}
+	return contains(kind.names(&w.Template.Spec), name)
+}
+
+// listed returns the configs of the kind listed in the reload annotation of the workload.
+func listed(w *workload, kind configKind) []string {
+	var names []string
+	for _, name := range strings.Split(w.Annotations[kind.listAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// configHashAnnotation returns the workload and pod template annotation recording the data hash of the named
+// configmap or secret, e.g. kontroller/config-hash-configmap-app. Names too long for an annotation
+// key are truncated and suffixed with a hash of the full name to stay unique.
+func configHashAnnotation(kind, name string) string {
+	// The name part of an annotation key, here "config-hash-<kind>-<name>", is limited to 63 characters.
+	const maxSuffixLength = 63 - len("config-hash-")
+	suffix := kind + "-" + name
+	if len(suffix) > maxSuffixLength {
+		hash, _ := utils.HashCompute(suffix)
+		suffix = suffix[:maxSuffixLength-9] + "-" + hash[:8]
+	}
+	return ConfigHashAnnotation + "-" + suffix
 }
 
 type Option func(reloader *Reloader)
@@ -63,22 +338,88 @@ func Namespace(n string) Option {
 	}
 }
 
+// Resource sets the watched resource, either common.ConfigMaps or common.Secrets.
+func Resource(resource string) Option {
+	return func(reloader *Reloader) {
+		switch resource {
+		case common.Secrets:
+			reloader.Resource, reloader.Object = common.Secrets, &corev1.Secret{}
+		default:
+			reloader.Resource, reloader.Object = common.ConfigMaps, &corev1.ConfigMap{}
+		}
+	}
+}
+
 func LabelSelector(l string) Option {
 	return func(reloader *Reloader) {
 		reloader.LabelSelector = strings.ReplaceAll(strings.ToLower(l), " ", "")
 	}
 }
 
+// RestartRate limits the workload restarts to qps per second, allowing bursts of burst restarts.
+func RestartRate(qps float64, burst int) Option {
+	return func(reloader *Reloader) {
+		reloader.RestartLimiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+}
+
+// OptInSyncPeriod sets the resync period of the workload informers.
+func OptInSyncPeriod(d time.Duration) Option {
+	return func(reloader *Reloader) {
+		reloader.OptInSyncPeriod = d
+	}
+}
+
+// ConfigOptions returns the options of the reloader settings of config.yaml.
+// The restartQPS and restartBurst settings limit the workload restarts, the burst defaulting to 1.
+// The optInSyncPeriod setting is a duration like "1m".
+func ConfigOptions(settings config.ControllerSettings) ([]Option, error) {
+	var options []Option
+	if settings.Namespace != nil {
+		options = append(options, Namespace(*settings.Namespace))
+	}
+	if settings.LabelSelector != nil {
+		options = append(options, LabelSelector(*settings.LabelSelector))
+	}
+	if value, ok := settings.Settings["restartqps"]; ok {
+		qps, err := strconv.ParseFloat(value, 64)
+		if err != nil || qps <= 0 {
+			return nil, fmt.Errorf("invalid restartQPS setting %q", value)
+		}
+		burst := 1
+		if value, ok := settings.Settings["restartburst"]; ok {
+			if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid restartBurst setting %q", value)
+			}
+		}
+		options = append(options, RestartRate(qps, burst))
+	}
+	if value, ok := settings.Settings["optinsyncperiod"]; ok {
+		period, err := time.ParseDuration(value)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid optInSyncPeriod setting %q", value)
+		}
+		options = append(options, OptInSyncPeriod(period))
+	}
+	return options, nil
+}
+
 func NewReloader(name string, options ...Option) *Reloader {
 	r := &Reloader{
-		Name:          name,
-		Resource:      common.ConfigMaps,
-		Object:        &corev1.ConfigMap{},
-		Namespace:     corev1.NamespaceAll,
-		LabelSelector: DefaultLabelSelector,
+		Name:            name,
+		Resource:        common.ConfigMaps,
+		Object:          &corev1.ConfigMap{},
+		Namespace:       corev1.NamespaceAll,
+		LabelSelector:   DefaultLabelSelector,
+		OptInSyncPeriod: DefaultOptInSyncPeriod,
 	}
 	for _, option := range options {
 		option(r)
 	}
 	return r
 }
+
+// NewSecretReloader creates a reloader watching secrets instead of configmaps.
+func NewSecretReloader(name string, options ...Option) *Reloader {
+	return NewReloader(name, append([]Option{Resource(common.Secrets)}, options...)...)
+}
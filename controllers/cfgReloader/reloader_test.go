@@ -0,0 +1,531 @@
+package cfgReloader
+
+import (
+	"Kontroller/config"
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/common"
+	"Kontroller/pkg/utils"
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNamespace = "default"
+
+var reloaderLabels = map[string]string{"kontroller/reloader": "true"}
+
+func newConfigMap(name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: reloaderLabels},
+		Data:       map[string]string{"key": "value"},
+	}
+}
+
+func newDeployment(name string, spec corev1.PodSpec) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+	}
+}
+
+func newStatefulSet(name string, spec corev1.PodSpec) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+	}
+}
+
+func newDaemonSet(name string, spec corev1.PodSpec) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+	}
+}
+
+func volumeSpec(configmap string) corev1.PodSpec {
+	return corev1.PodSpec{Volumes: []corev1.Volume{{
+		Name:         "config",
+		VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: configmap}}},
+	}}}
+}
+
+// runWatch runs the workload informers of the reloader until the test finished and returns its queue.
+func runWatch(t *testing.T, r *Reloader, client kubernetes.Interface) workqueue.RateLimitingInterface {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	stopper := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopper)
+		queue.ShutDown()
+	})
+	for _, informer := range r.Watch(client, queue, 0) {
+		go informer.Run(stopper)
+		if !cache.WaitForCacheSync(stopper, informer.HasSynced) {
+			t.Fatalf("Workload cache not synced.")
+		}
+	}
+	return queue
+}
+
+// waitForCache waits until the cached deployment satisfies the condition.
+func waitForCache(t *testing.T, r *Reloader, name string, condition func(d *appsv1.Deployment) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, indexer := range r.workloads {
+			obj, exists, _ := indexer.GetByKey(testNamespace + "/" + name)
+			if d, ok := obj.(*appsv1.Deployment); exists && ok && condition(d) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Deployment %s not updated in the cache.", name)
+}
+
+func TestConfigMapNames(t *testing.T) {
+	ref := corev1.LocalObjectReference{Name: "app"}
+	specs := map[string]corev1.PodSpec{
+		"volume": volumeSpec("app"),
+		"projected": {Volumes: []corev1.Volume{{
+			Name: "projected",
+			VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{
+				{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: ref}},
+			}}},
+		}}},
+		"envFrom": {Containers: []corev1.Container{{
+			EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: ref}}},
+		}}},
+		"valueFrom": {InitContainers: []corev1.Container{{
+			Env: []corev1.EnvVar{{Name: "KEY", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: ref, Key: "key"}}}},
+		}}},
+	}
+	for name, spec := range specs {
+		if names := configMapNames(&spec); len(names) != 1 || names[0] != "app" {
+			t.Errorf("Reference through %s not detected.", name)
+		}
+	}
+}
+
+func TestReloader_HandleObject(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newDeployment("consumer", volumeSpec("app")),
+		newDeployment("bystander", volumeSpec("other")),
+		newStatefulSet("consumer", volumeSpec("app")),
+		newDaemonSet("consumer", volumeSpec("app")),
+	)
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	if err := r.HandleObject(client, newConfigMap("app")); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	key := configHashAnnotation("configmap", "app")
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if _, ok := consumer.Annotations[key]; !ok {
+		t.Errorf("Deployment consuming the configmap does not follow it.")
+	}
+	bystander, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "bystander", metav1.GetOptions{})
+	if _, ok := bystander.Annotations[key]; ok {
+		t.Errorf("Deployment not consuming the configmap follows it.")
+	}
+	sts, _ := client.AppsV1().StatefulSets(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if _, ok := sts.Annotations[key]; !ok {
+		t.Errorf("StatefulSet consuming the configmap does not follow it.")
+	}
+	ds, _ := client.AppsV1().DaemonSets(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if _, ok := ds.Annotations[key]; !ok {
+		t.Errorf("DaemonSet consuming the configmap does not follow it.")
+	}
+}
+
+func TestReloader_HandleObject_UnexpectedType(t *testing.T) {
+	r := NewReloader(ReloaderName)
+	if err := r.HandleObject(fake.NewSimpleClientset(), nil); err == nil {
+		t.Errorf("Expected error for unexpected object type, but got no error.")
+	}
+}
+
+func TestReloader_HandleObject_Secret(t *testing.T) {
+	secretSpec := corev1.PodSpec{Containers: []corev1.Container{{
+		EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "tls"}}}},
+	}}}
+	client := fake.NewSimpleClientset(
+		newDeployment("consumer", secretSpec),
+		newDeployment("bystander", volumeSpec("tls")),
+	)
+	r := NewSecretReloader(SecretReloaderName)
+	runWatch(t, r, client)
+	key := configHashAnnotation("secret", "tls")
+	if r.ControlResourceName() != common.Secrets {
+		t.Errorf("Resource is incorrect, got: %s, want: %s.", r.ControlResourceName(), common.Secrets)
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: testNamespace, Labels: reloaderLabels}}
+	if err := r.HandleObject(client, secret); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if _, ok := consumer.Annotations[key]; !ok {
+		t.Errorf("Deployment consuming the secret does not follow it.")
+	}
+	bystander, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "bystander", metav1.GetOptions{})
+	if _, ok := bystander.Annotations[key]; ok {
+		t.Errorf("Deployment mounting a configmap of the same name follows it.")
+	}
+}
+
+func TestReloader_HandleObject_SecretHash(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: testNamespace, UID: "tls-uid", Labels: reloaderLabels},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+	}
+	legacyHash, _ := utils.HashCompute(map[string]interface{}{"data": secret.Data})
+	key := configHashAnnotation("secret", "tls")
+	migrated := newDeployment("migrated", volumeSpec("other"))
+	migrated.Spec.Template.Spec.Containers = []corev1.Container{{
+		EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "tls"}}}},
+	}}
+	migrated.Spec.Template.Annotations = map[string]string{key: legacyHash}
+	fresh := migrated.DeepCopy()
+	fresh.Name, fresh.Spec.Template.Annotations = "fresh", nil
+	client := fake.NewSimpleClientset(migrated, fresh)
+	r := NewSecretReloader(SecretReloaderName)
+	runWatch(t, r, client)
+	if err := r.HandleObject(client, secret); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	want, _ := utils.HMACCompute([]byte(secret.UID), map[string]interface{}{"data": secret.Data})
+	for _, name := range []string{"migrated", "fresh"} {
+		d, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if got := d.Annotations[key]; got != want || got == legacyHash {
+			t.Errorf("Recorded hash of %s is incorrect, got: %s, want: %s.", name, got, want)
+		}
+		// The unkeyed hash of unchanged data is replaced without a restart.
+		if got := d.Spec.Template.Annotations[key]; name == "migrated" && got != legacyHash {
+			t.Errorf("Deployment %s restarted although the secret did not change.", name)
+		}
+	}
+	// The hash is keyed with the secret, equal data of another secret hashes differently.
+	other, _, _ := secretHashes(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{UID: "other-uid"}, Data: secret.Data})
+	if other == want {
+		t.Errorf("Hashes of secrets with equal data are equal.")
+	}
+}
+
+func TestReloader_HandleObject_UnchangedData(t *testing.T) {
+	client := fake.NewSimpleClientset(newDeployment("consumer", volumeSpec("app")))
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	configmap := newConfigMap("app")
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	waitForCache(t, r, "consumer", func(d *appsv1.Deployment) bool {
+		return d.Annotations[configHashAnnotation("configmap", "app")] != ""
+	})
+	// A metadata-only change must not patch the workload again.
+	configmap.Labels = map[string]string{"kontroller/reloader": "true", "team": "a"}
+	client.ClearActions()
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("Workload patched although the configmap data did not change.")
+		}
+	}
+	// A data change must roll the workload with the new hash.
+	configmap.Data["key"] = "new value"
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	want, _ := utils.HashCompute(map[string]interface{}{"data": configmap.Data, "binaryData": configmap.BinaryData})
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if got := consumer.Spec.Template.Annotations[configHashAnnotation("configmap", "app")]; got != want {
+		t.Errorf("Config hash is incorrect, got: %s, want: %s.", got, want)
+	}
+}
+
+func TestReloader_HandleObject_WorkloadAnnotations(t *testing.T) {
+	annotated := func(d *appsv1.Deployment, annotations map[string]string) *appsv1.Deployment {
+		d.Annotations = annotations
+		return d
+	}
+	client := fake.NewSimpleClientset(
+		newDeployment("unannotated", volumeSpec("app")),
+		annotated(newDeployment("listed", corev1.PodSpec{}), map[string]string{ReloadConfigMapsAnnotation: "other, app"}),
+		annotated(newDeployment("auto", volumeSpec("app")), map[string]string{AutoReloadAnnotation: "true"}),
+		annotated(newDeployment("auto-unreferenced", volumeSpec("other")), map[string]string{AutoReloadAnnotation: "true"}),
+		annotated(newDeployment("secrets-only", volumeSpec("app")), map[string]string{ReloadSecretsAnnotation: "app"}),
+	)
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	configmap := newConfigMap("app")
+	configmap.Labels = nil
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	key := configHashAnnotation("configmap", "app")
+	want := map[string]bool{"unannotated": false, "listed": true, "auto": true, "auto-unreferenced": false, "secrets-only": false}
+	for name, followed := range want {
+		d, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if _, ok := d.Annotations[key]; ok != followed {
+			t.Errorf("Deployment %s followed is incorrect, got: %t, want: %t.", name, ok, followed)
+		}
+	}
+}
+
+func TestReloader_HandleObject_OptOut(t *testing.T) {
+	optOut := newDeployment("opt-out", volumeSpec("app"))
+	optOut.Annotations = map[string]string{ReloadAnnotation: "false", ReloadConfigMapsAnnotation: "app"}
+	client := fake.NewSimpleClientset(optOut)
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	if err := r.HandleObject(client, newConfigMap("app")); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	d, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "opt-out", metav1.GetOptions{})
+	if _, ok := d.Annotations[configHashAnnotation("configmap", "app")]; ok {
+		t.Errorf("Deployment opted out of reloads follows it.")
+	}
+}
+
+func TestConfigHashAnnotation(t *testing.T) {
+	if got := configHashAnnotation("configmap", "app"); got != "kontroller/config-hash-configmap-app" {
+		t.Errorf("Annotation key is incorrect, got: %s, want: %s.", got, "kontroller/config-hash-configmap-app")
+	}
+	long := configHashAnnotation("configmap", strings.Repeat("a", 253))
+	if name := long[strings.Index(long, "/")+1:]; len(name) > 63 {
+		t.Errorf("Annotation key name is too long, got: %d, want: <= %d.", len(name), 63)
+	}
+	if long == configHashAnnotation("configmap", strings.Repeat("a", 252)) {
+		t.Errorf("Truncated annotation keys of different names collide.")
+	}
+}
+
+func TestReloader_Reconcile(t *testing.T) {
+	r := NewReloader(ReloaderName)
+	if reconciler := api.AsReconciler(r); reconciler != api.Reconciler(r) {
+		t.Errorf("Reloader is adapted instead of reconciling with the context.")
+	}
+	if _, err := r.Reconcile(context.Background(), api.Request{Key: "default/app", Namespace: testNamespace, Name: "app", Client: fake.NewSimpleClientset()}); err != nil {
+		t.Errorf("Deleted config reconcile failed with err: %v", err)
+	}
+}
+
+func TestReloader_HandleObject_NotWatching(t *testing.T) {
+	r := NewReloader(ReloaderName)
+	if err := r.HandleObject(fake.NewSimpleClientset(), newConfigMap("app")); err == nil {
+		t.Errorf("Expected error for reloading without the workload caches, but got no error.")
+	}
+}
+
+func TestReloader_Watch_EnqueuesOptedInConfigs(t *testing.T) {
+	listed := newDeployment("listed", corev1.PodSpec{})
+	listed.Annotations = map[string]string{ReloadConfigMapsAnnotation: "a, b", ReloadSecretsAnnotation: "tls"}
+	auto := newDeployment("auto", volumeSpec("c"))
+	auto.Annotations = map[string]string{AutoReloadAnnotation: "true"}
+	optOut := newDeployment("opt-out", corev1.PodSpec{})
+	optOut.Annotations = map[string]string{ReloadAnnotation: "false", ReloadConfigMapsAnnotation: "d"}
+	client := fake.NewSimpleClientset(listed, auto, optOut, newDeployment("unannotated", volumeSpec("e")))
+	queue := runWatch(t, NewReloader(ReloaderName), client)
+	got := map[string]bool{}
+	for queue.Len() > 0 {
+		key, _ := queue.Get()
+		got[key.(string)] = true
+		queue.Done(key)
+	}
+	// New workloads record the hash of every consumed config.
+	want := map[string]bool{"default/a": true, "default/b": true, "default/c": true, "default/e": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Enqueued configs are incorrect, got: %v, want: %v.", got, want)
+	}
+}
+
+func TestReloader_Watch_OptInSync(t *testing.T) {
+	listed := newDeployment("listed", volumeSpec("e"))
+	listed.Annotations = map[string]string{ReloadConfigMapsAnnotation: "a"}
+	queue := runWatch(t, NewReloader(ReloaderName, OptInSyncPeriod(100*time.Millisecond)), fake.NewSimpleClientset(listed))
+	drained := time.Now()
+	for queue.Len() > 0 {
+		key, _ := queue.Get()
+		queue.Done(key)
+	}
+	// Resyncs enqueue the opted-in configs only, not every consumed one.
+	key, _ := queue.Get()
+	queue.Done(key)
+	if key != "default/a" || time.Since(drained) > time.Second {
+		t.Errorf("Resynced config is incorrect, got: %v after %v, want: %v.", key, time.Since(drained), "default/a")
+	}
+}
+
+func TestReloader_Watch_NewWorkload(t *testing.T) {
+	configmap := newConfigMap("app")
+	client := fake.NewSimpleClientset(configmap)
+	r := NewReloader(ReloaderName)
+	queue := runWatch(t, r, client)
+	// A deployment created after the reloader started, mounting the labelled configmap without annotations.
+	if _, err := client.AppsV1().Deployments(testNamespace).Create(context.TODO(), newDeployment("consumer", volumeSpec("app")), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	key, _ := queue.Get()
+	queue.Done(key)
+	if key != "default/app" {
+		t.Fatalf("Enqueued config is incorrect, got: %v, want: %v.", key, "default/app")
+	}
+	waitForCache(t, r, "consumer", func(d *appsv1.Deployment) bool { return true })
+	req := api.Request{Key: "default/app", Namespace: testNamespace, Name: "app", Object: configmap, Client: client}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	hashKey := configHashAnnotation("configmap", "app")
+	waitForCache(t, r, "consumer", func(d *appsv1.Deployment) bool { return d.Annotations[hashKey] != "" })
+	// The next change of the configmap restarts the deployment without waiting for a resync.
+	configmap.Data["key"] = "new value"
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if _, ok := consumer.Spec.Template.Annotations[hashKey]; !ok {
+		t.Errorf("Deployment not restarted after the configmap changed.")
+	}
+}
+
+func TestReloader_Reconcile_UnlabelledConfig(t *testing.T) {
+	configmap := newConfigMap("app")
+	configmap.Labels = nil
+	listed := newDeployment("listed", corev1.PodSpec{})
+	listed.Annotations = map[string]string{ReloadConfigMapsAnnotation: "app"}
+	client := fake.NewSimpleClientset(configmap, listed, newDeployment("unannotated", volumeSpec("app")))
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	client.ClearActions()
+	// The unlabelled config is not in the cache of the labelled ones, so it is fetched.
+	if _, err := r.Reconcile(context.Background(), api.Request{Key: "default/app", Namespace: testNamespace, Name: "app", Client: client}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	key := configHashAnnotation("configmap", "app")
+	want := map[string]bool{"listed": true, "unannotated": false}
+	for name, followed := range want {
+		d, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if _, ok := d.Annotations[key]; ok != followed {
+			t.Errorf("Deployment %s followed is incorrect, got: %t, want: %t.", name, ok, followed)
+		}
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "list" {
+			t.Errorf("Consumers resolved by listing %s instead of the caches.", action.GetResource().Resource)
+		}
+	}
+}
+
+func TestReloader_ControlLabelSelector(t *testing.T) {
+	if got := NewReloader(ReloaderName).ControlLabelSelector(); got != DefaultLabelSelector {
+		t.Errorf("Label selector is incorrect, got: %s, want: %s.", got, DefaultLabelSelector)
+	}
+}
+
+func TestReloader_HandleObject_FirstSight(t *testing.T) {
+	client := fake.NewSimpleClientset(newDeployment("consumer", volumeSpec("app")))
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	configmap := newConfigMap("app")
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	key := configHashAnnotation("configmap", "app")
+	want, _ := utils.HashCompute(map[string]interface{}{"data": configmap.Data, "binaryData": configmap.BinaryData})
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if got := consumer.Annotations[key]; got != want {
+		t.Errorf("Recorded hash is incorrect, got: %s, want: %s.", got, want)
+	}
+	if _, ok := consumer.Spec.Template.Annotations[key]; ok {
+		t.Errorf("Deployment restarted on first sight.")
+	}
+}
+
+func TestReloader_HandleObject_TemplateStamp(t *testing.T) {
+	// Workloads stamped on the pod template only keep their hash, and restart once it differs.
+	configmap := newConfigMap("app")
+	hash, _ := utils.HashCompute(map[string]interface{}{"data": configmap.Data, "binaryData": configmap.BinaryData})
+	key := configHashAnnotation("configmap", "app")
+	stamped := newDeployment("consumer", volumeSpec("app"))
+	stamped.Spec.Template.Annotations = map[string]string{key: hash}
+	client := fake.NewSimpleClientset(stamped)
+	r := NewReloader(ReloaderName)
+	runWatch(t, r, client)
+	client.ClearActions()
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("Workload patched although the stamped hash did not change.")
+	}
+	configmap.Data["key"] = "new value"
+	if err := r.HandleObject(client, configmap); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	consumer, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), "consumer", metav1.GetOptions{})
+	if got := consumer.Spec.Template.Annotations[key]; got == hash {
+		t.Errorf("Deployment not restarted after the data changed.")
+	}
+}
+
+func TestReloader_Reconcile_RestartRate(t *testing.T) {
+	configmap := newConfigMap("app")
+	key := configHashAnnotation("configmap", "app")
+	var objects []runtime.Object
+	for _, name := range []string{"a", "b"} {
+		d := newDeployment(name, volumeSpec("app"))
+		d.Annotations = map[string]string{key: "old"}
+		objects = append(objects, d)
+	}
+	client := fake.NewSimpleClientset(objects...)
+	r := NewReloader(ReloaderName, RestartRate(0.1, 1))
+	runWatch(t, r, client)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// The burst restarts one deployment, the other one would exceed the reconcile timeout.
+	if _, err := r.Reconcile(ctx, api.Request{Key: "default/app", Object: configmap, Client: client}); err == nil {
+		t.Errorf("Expected error for throttled restarts, but got no error.")
+	}
+	restarted := 0
+	for _, name := range []string{"a", "b"} {
+		d, _ := client.AppsV1().Deployments(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if _, ok := d.Spec.Template.Annotations[key]; ok {
+			restarted++
+		}
+	}
+	if restarted != 1 {
+		t.Errorf("Restarted deployments count is incorrect, got: %d, want: %d.", restarted, 1)
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	options, err := ConfigOptions(config.ControllerSettings{Settings: map[string]string{"restartqps": "0.5", "restartburst": "3", "optinsyncperiod": "30s"}})
+	if err != nil {
+		t.Fatalf("ConfigOptions failed with err: %v", err)
+	}
+	r := NewReloader(ReloaderName, options...)
+	if r.RestartLimiter == nil || r.RestartLimiter.Limit() != 0.5 || r.RestartLimiter.Burst() != 3 {
+		t.Errorf("Restart limiter is incorrect, got: %v.", r.RestartLimiter)
+	}
+	if r.OptInSyncPeriod != 30*time.Second {
+		t.Errorf("Opt-in sync period is incorrect, got: %v, want: %v.", r.OptInSyncPeriod, 30*time.Second)
+	}
+	if NewReloader(ReloaderName).RestartLimiter != nil {
+		t.Errorf("Restarts limited without restartQPS setting.")
+	}
+	for _, settings := range []map[string]string{{"restartqps": "fast"}, {"restartqps": "1", "restartburst": "0"}, {"optinsyncperiod": "0s"}} {
+		if _, err := ConfigOptions(config.ControllerSettings{Settings: settings}); err == nil {
+			t.Errorf("Expected error for invalid settings %v, but got no error.", settings)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package cfgReloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Workload kinds rolled by the reloader.
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+)
+
+// workload is a pod template owner that can be restarted by patching its template.
+type workload struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+	Template    *corev1.PodTemplateSpec
+}
+
+func (w *workload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.Kind, w.Namespace, w.Name)
+}
+
+// configIndex indexes the workloads by the configs they consume or list in their reload annotations,
+// see configIndexKey.
+const configIndex = "config"
+
+// configIndexKey returns the configIndex key of the config of the kind, e.g. configmap/default/app.
+func configIndexKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// configIndexFunc returns the keys of the configmaps and secrets the workload consumes or lists.
+func configIndexFunc(obj interface{}) ([]string, error) {
+	w := toWorkload(obj)
+	if w == nil {
+		return nil, nil
+	}
+	var keys []string
+	for _, kind := range []configKind{configMapKind, secretKind} {
+		for _, name := range append(kind.names(&w.Template.Spec), listed(w, kind)...) {
+			keys = append(keys, configIndexKey(kind.name, w.Namespace, name))
+		}
+	}
+	return keys, nil
+}
+
+// toWorkload returns the workload of a deployment, statefulSet or daemonSet, nil for other objects.
+func toWorkload(obj interface{}) *workload {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload{Kind: KindDeployment, Namespace: o.Namespace, Name: o.Name, Annotations: o.Annotations, Template: &o.Spec.Template}
+	case *appsv1.StatefulSet:
+		return &workload{Kind: KindStatefulSet, Namespace: o.Namespace, Name: o.Name, Annotations: o.Annotations, Template: &o.Spec.Template}
+	case *appsv1.DaemonSet:
+		return &workload{Kind: KindDaemonSet, Namespace: o.Namespace, Name: o.Name, Annotations: o.Annotations, Template: &o.Spec.Template}
+	}
+	return nil
+}
+
+// workloadListWatches returns the list watches of the deployments, statefulSets and daemonSets in the
+// namespace, keyed by their object type.
+func workloadListWatches(client kubernetes.Interface, namespace string) map[runtime.Object]*cache.ListWatch {
+	apps := client.AppsV1()
+	return map[runtime.Object]*cache.ListWatch{
+		&appsv1.Deployment{}: {
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return apps.Deployments(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return apps.Deployments(namespace).Watch(ctx, options)
+			},
+		},
+		&appsv1.StatefulSet{}: {
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return apps.StatefulSets(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return apps.StatefulSets(namespace).Watch(ctx, options)
+			},
+		},
+		&appsv1.DaemonSet{}: {
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return apps.DaemonSets(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return apps.DaemonSets(namespace).Watch(ctx, options)
+			},
+		},
+	}
+}
+
+// patchAnnotations merges the annotations into the workload, and into its pod template if restart is set,
+// which triggers a rolling update.
+func patchAnnotations(ctx context.Context, client kubernetes.Interface, w *workload, annotations map[string]string, restart bool) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	if restart {
+		patch["spec"] = map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": annotations,
+				},
+			},
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	switch w.Kind {
+	case KindDeployment:
+		_, err = client.AppsV1().Deployments(w.Namespace).Patch(ctx, w.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case KindStatefulSet:
+		_, err = client.AppsV1().StatefulSets(w.Namespace).Patch(ctx, w.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	case KindDaemonSet:
+		_, err = client.AppsV1().DaemonSets(w.Namespace).Patch(ctx, w.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("unsupported workload kind: %s", w.Kind)
+	}
+	return err
+}
+
+// configMapNames returns the configmaps the pod spec consumes through volumes, projected volumes,
+// envFrom or env valueFrom.
+func configMapNames(spec *corev1.PodSpec) []string {
+	var names []string
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			names = append(names, volume.ConfigMap.Name)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					names = append(names, source.ConfigMap.Name)
+				}
+			}
+		}
+	}
+	for _, container := range allContainers(spec) {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil {
+				names = append(names, envFrom.ConfigMapRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+				names = append(names, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+		}
+	}
+	return names
+}
+
+// secretNames returns the secrets the pod spec consumes through volumes, projected volumes,
+// envFrom or env valueFrom.
+func secretNames(spec *corev1.PodSpec) []string {
+	var names []string
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil {
+			names = append(names, volume.Secret.SecretName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					names = append(names, source.Secret.Name)
+				}
+			}
+		}
+	}
+	for _, container := range allContainers(spec) {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil {
+				names = append(names, envFrom.SecretRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				names = append(names, env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+	return names
+}
+
+// contains reports whether the name is one of the names.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allContainers returns the init containers and containers of the pod spec.
+func allContainers(spec *corev1.PodSpec) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(spec.InitContainers)+len(spec.Containers))
+	containers = append(containers, spec.InitContainers...)
+	return append(containers, spec.Containers...)
+}
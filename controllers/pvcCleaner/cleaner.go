@@ -0,0 +1,241 @@
+package pvcCleaner
+
+import (
+	"Kontroller/config"
+	"Kontroller/logging"
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/common"
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var log *logging.Logging
+
+const (
+	CleanerName          = "pvc-cleaner"
+	DefaultLabelSelector = "kontroller/pvc-cleaner=true"
+	// DefaultGracePeriod keeps the claims of a scale-down for a quick scale back up.
+	DefaultGracePeriod = 10 * time.Minute
+)
+
+func init() {
+	log = logging.NewLogging(CleanerName)
+}
+
+// Cleaner makes the statefulSet own the claims created from its volumeClaimTemplates,
+// so the garbage collector deletes them once the statefulSet is deleted, and optionally
+// deletes the claims of ordinals removed by a scale-down.
+type Cleaner struct {
+	Name          string
+	Resource      string
+	Object        runtime.Object
+	Namespace     string
+	LabelSelector string
+	GracePeriod   time.Duration
+}
+
+func (c *Cleaner) ControllerName() string {
+	return c.Name
+}
+
+func (c *Cleaner) ControlObject() runtime.Object {
+	return c.Object
+}
+
+func (c *Cleaner) ControlResourceName() string {
+	return c.Resource
+}
+
+func (c *Cleaner) ControlNamespace() string {
+	return c.Namespace
+}
+
+func (c *Cleaner) ControlLabelSelector() string {
+	return c.LabelSelector
+}
+
+// HandleObject applies the retention policy of the statefulSet to every claim it created.
+func (c *Cleaner) HandleObject(client kubernetes.Interface, object interface{}) error {
+	_, err := c.Reconcile(context.TODO(), api.Request{Object: object, Client: client})
+	return err
+}
+
+// Reconcile applies the retention policy of the statefulSet to every claim it created, and requeues
+// the statefulSet once the grace period of the next scaled down claim has passed. The adopted claims of
+// a deleted statefulSet are left to the garbage collector, the others are deleted by cleanUp.
+func (c *Cleaner) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	if req.Object == nil {
+		return api.Result{}, cleanUp(ctx, req.Client, req.LastKnownState)
+	}
+	sts, ok := req.Object.(*appsv1.StatefulSet)
+	if !ok {
+		return api.Result{}, fmt.Errorf("unexpected object type %T", req.Object)
+	}
+	if sts.DeletionTimestamp != nil {
+		return api.Result{}, nil
+	}
+	policy, err := retentionPolicy(sts)
+	if err != nil {
+		return api.Result{}, err
+	}
+	gracePeriod, err := c.gracePeriod(sts)
+	if err != nil {
+		return api.Result{}, err
+	}
+	client := req.Client
+	claims, err := listClaims(ctx, client, sts)
+	if err != nil {
+		return api.Result{}, err
+	}
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	// The pods are numbered from spec.ordinals.start, claims of lower ordinals are not scaled down.
+	start := int32(0)
+	if sts.Spec.Ordinals != nil {
+		start = sts.Spec.Ordinals.Start
+	}
+	now := time.Now()
+	var result api.Result
+	var errs []error
+	for i := range claims {
+		claim := &claims[i]
+		ordinal, _ := claimOrdinal(sts, claim.Name)
+		var remaining time.Duration
+		switch {
+		case policy == RetentionRetain:
+			err = release(ctx, client, claim, sts)
+		case policy == RetentionDeleteOnScaleDown && int32(ordinal) >= start+replicas:
+			remaining, err = reclaim(ctx, client, claim, sts, gracePeriod, now)
+		default:
+			err = adopt(ctx, client, claim, sts)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sync pvc %s/%s failed: %v", claim.Namespace, claim.Name, err))
+		}
+		if remaining > 0 && (result.RequeueAfter == 0 || remaining < result.RequeueAfter) {
+			result.RequeueAfter = remaining
+		}
+	}
+	if len(errs) > 0 {
+		return api.Result{}, utilerrors.NewAggregate(errs)
+	}
+	return result, nil
+}
+
+// gracePeriod returns the grace period annotated on the statefulSet, or the cleaner default.
+func (c *Cleaner) gracePeriod(sts *appsv1.StatefulSet) (time.Duration, error) {
+	value, ok := sts.Annotations[GracePeriodAnnotation]
+	if !ok {
+		return c.GracePeriod, nil
+	}
+	gracePeriod, err := time.ParseDuration(value)
+	if err != nil || gracePeriod < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q on statefulSet %s/%s", GracePeriodAnnotation, value, sts.Namespace, sts.Name)
+	}
+	return gracePeriod, nil
+}
+
+// listClaims lists the claims created from the volumeClaimTemplates of the statefulSet,
+// named <template>-<statefulSet>-<ordinal> and labelled with the statefulSet selector.
+func listClaims(ctx context.Context, client kubernetes.Interface, sts *appsv1.StatefulSet) ([]corev1.PersistentVolumeClaim, error) {
+	if len(sts.Spec.VolumeClaimTemplates) == 0 {
+		return nil, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.CoreV1().PersistentVolumeClaims(sts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var claims []corev1.PersistentVolumeClaim
+	for _, claim := range list.Items {
+		if _, ok := claimOrdinal(sts, claim.Name); ok {
+			claims = append(claims, claim)
+		}
+	}
+	return claims, nil
+}
+
+// claimOrdinal returns the pod ordinal of a claim created by the statefulSet.
+func claimOrdinal(sts *appsv1.StatefulSet, claimName string) (int, bool) {
+	for _, template := range sts.Spec.VolumeClaimTemplates {
+		prefix := template.Name + "-" + sts.Name + "-"
+		if !strings.HasPrefix(claimName, prefix) {
+			continue
+		}
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(claimName, prefix))
+		if err == nil && ordinal >= 0 {
+			return ordinal, true
+		}
+	}
+	return 0, false
+}
+
+type Option func(cleaner *Cleaner)
+
+func Namespace(n string) Option {
+	return func(cleaner *Cleaner) {
+		cleaner.Namespace = n
+	}
+}
+
+// GracePeriod sets the default delay before deleting a claim after a scale-down.
+func GracePeriod(d time.Duration) Option {
+	return func(cleaner *Cleaner) {
+		cleaner.GracePeriod = d
+	}
+}
+
+func LabelSelector(l string) Option {
+	return func(cleaner *Cleaner) {
+		cleaner.LabelSelector = strings.ReplaceAll(strings.ToLower(l), " ", "")
+	}
+}
+
+// ConfigOptions returns the options of the cleaner settings of config.yaml.
+// The gracePeriod setting is a duration like "10m".
+func ConfigOptions(settings config.ControllerSettings) ([]Option, error) {
+	var options []Option
+	if settings.Namespace != nil {
+		options = append(options, Namespace(*settings.Namespace))
+	}
+	if settings.LabelSelector != nil {
+		options = append(options, LabelSelector(*settings.LabelSelector))
+	}
+	if value, ok := settings.Settings["graceperiod"]; ok {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil || gracePeriod < 0 {
+			return nil, fmt.Errorf("invalid gracePeriod setting %q", value)
+		}
+		options = append(options, GracePeriod(gracePeriod))
+	}
+	return options, nil
+}
+
+func NewCleaner(name string, options ...Option) *Cleaner {
+	c := &Cleaner{
+		Name:          name,
+		Resource:      common.StatefulSets,
+		Object:        &appsv1.StatefulSet{},
+		Namespace:     corev1.NamespaceAll,
+		LabelSelector: DefaultLabelSelector,
+		GracePeriod:   DefaultGracePeriod,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
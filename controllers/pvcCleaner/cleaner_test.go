@@ -0,0 +1,294 @@
+package pvcCleaner
+
+import (
+	"Kontroller/config"
+	"Kontroller/pkg/api"
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+const testNamespace = "default"
+
+var appLabels = map[string]string{"app": "web"}
+
+func newStatefulSet(name string, replicas int32) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, UID: types.UID(name + "-uid")},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:             &replicas,
+			Selector:             &metav1.LabelSelector{MatchLabels: appLabels},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}},
+		},
+	}
+}
+
+func newClaim(name string, labels map[string]string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: labels}}
+}
+
+func TestClaimOrdinal(t *testing.T) {
+	sts := newStatefulSet("web", 1)
+	cases := map[string]bool{
+		"data-web-0":   true,
+		"data-web-12":  true,
+		"data-web-1-0": false,
+		"logs-web-0":   false,
+		"data-web-x":   false,
+	}
+	for name, want := range cases {
+		if _, ok := claimOrdinal(sts, name); ok != want {
+			t.Errorf("Claim %s matched is incorrect, got: %t, want: %t.", name, ok, want)
+		}
+	}
+}
+
+func TestCleaner_HandleObject(t *testing.T) {
+	sts := newStatefulSet("web", 2)
+	client := fake.NewSimpleClientset(
+		sts,
+		newClaim("data-web-0", appLabels),
+		newClaim("data-web-1", appLabels),
+		newClaim("data-web-1-0", appLabels),
+		newClaim("data-other-0", map[string]string{"app": "other"}),
+	)
+	c := NewCleaner(CleanerName)
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	want := map[string]bool{"data-web-0": true, "data-web-1": true, "data-web-1-0": false, "data-other-0": false}
+	for name, owned := range want {
+		claim, _ := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if got := isOwnedBy(claim, sts); got != owned {
+			t.Errorf("Claim %s owned is incorrect, got: %t, want: %t.", name, got, owned)
+		}
+	}
+	// Handling the statefulSet again must not duplicate owner references.
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	claim, _ := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-0", metav1.GetOptions{})
+	if len(claim.OwnerReferences) != 1 {
+		t.Errorf("Owner references count is incorrect, got: %d, want: %d.", len(claim.OwnerReferences), 1)
+	}
+}
+
+func TestCleaner_HandleObject_Retain(t *testing.T) {
+	sts := newStatefulSet("web", 1)
+	claim := newClaim("data-web-0", appLabels)
+	claim.OwnerReferences = []metav1.OwnerReference{ownerReference(sts)}
+	client := fake.NewSimpleClientset(sts, claim)
+	sts.Annotations = map[string]string{RetentionAnnotation: RetentionRetain}
+	c := NewCleaner(CleanerName)
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	claim, _ = client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-0", metav1.GetOptions{})
+	if isOwnedBy(claim, sts) {
+		t.Errorf("Claim of a statefulSet retaining its claims is still owned.")
+	}
+}
+
+func TestCleaner_HandleObject_DeleteOnScaleDown(t *testing.T) {
+	sts := newStatefulSet("web", 1)
+	sts.Annotations = map[string]string{RetentionAnnotation: RetentionDeleteOnScaleDown, GracePeriodAnnotation: "1h"}
+	client := fake.NewSimpleClientset(sts, newClaim("data-web-0", appLabels), newClaim("data-web-1", appLabels))
+	c := NewCleaner(CleanerName)
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	// Within the grace period the claim is only marked.
+	claim, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Claim deleted within the grace period: %v", err)
+	}
+	if _, ok := claim.Annotations[ScaledDownAnnotation]; !ok {
+		t.Errorf("Scaled down claim was not marked.")
+	}
+	// Scaling back up within the grace period keeps the claim.
+	replicas := int32(2)
+	sts.Spec.Replicas = &replicas
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	claim, _ = client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{})
+	if _, ok := claim.Annotations[ScaledDownAnnotation]; ok {
+		t.Errorf("Claim reused after scaling up is still marked.")
+	}
+	// Once the grace period has passed the claim is deleted.
+	replicas = 1
+	claim.Annotations[ScaledDownAnnotation] = time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	_, _ = client.CoreV1().PersistentVolumeClaims(testNamespace).Update(context.TODO(), claim, metav1.UpdateOptions{})
+	if err := c.HandleObject(client, sts); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{}); err == nil {
+		t.Errorf("Claim was not deleted after the grace period.")
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-0", metav1.GetOptions{}); err != nil {
+		t.Errorf("Claim of a running ordinal was deleted: %v", err)
+	}
+}
+
+func TestCleaner_Reconcile_RequeueAfter(t *testing.T) {
+	sts := newStatefulSet("web", 1)
+	sts.Annotations = map[string]string{RetentionAnnotation: RetentionDeleteOnScaleDown, GracePeriodAnnotation: "1h"}
+	client := fake.NewSimpleClientset(sts, newClaim("data-web-0", appLabels), newClaim("data-web-1", appLabels))
+	c := NewCleaner(CleanerName)
+	result, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", Object: sts, Client: client})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	// The statefulSet is requeued when the grace period of the scaled down claim ends.
+	if result.RequeueAfter <= 59*time.Minute || result.RequeueAfter > time.Hour {
+		t.Errorf("Requeue after is incorrect, got: %v, want: %v.", result.RequeueAfter, time.Hour)
+	}
+	result, err = c.Reconcile(context.TODO(), api.Request{Key: "default/web", Client: client})
+	if err != nil || result != (api.Result{}) {
+		t.Errorf("Deletion result is incorrect, got: %+v, %v, want: %+v.", result, err, api.Result{})
+	}
+}
+
+func TestCleaner_Reconcile_Deleted(t *testing.T) {
+	sts := newStatefulSet("web", 2)
+	adopted := newClaim("data-web-0", appLabels)
+	adopted.OwnerReferences = []metav1.OwnerReference{ownerReference(sts)}
+	foreign := newClaim("data-web-2", appLabels)
+	foreign.OwnerReferences = []metav1.OwnerReference{{Kind: "Other", Name: "other", UID: "other-uid"}}
+	newClient := func() *fake.Clientset {
+		return fake.NewSimpleClientset(adopted, newClaim("data-web-1", appLabels), foreign)
+	}
+	c := NewCleaner(CleanerName)
+	// The claim not adopted before the statefulSet was deleted is deleted, the others are kept.
+	client := newClient()
+	if _, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", LastKnownState: sts, Client: client}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	want := map[string]bool{"data-web-0": true, "data-web-1": false, "data-web-2": true}
+	for name, kept := range want {
+		if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), name, metav1.GetOptions{}); (err == nil) != kept {
+			t.Errorf("Claim %s kept is incorrect, got: %t, want: %t.", name, err == nil, kept)
+		}
+	}
+	// The claims are kept for a statefulSet retaining them, or deleted with --cascade=orphan.
+	retaining := newStatefulSet("web", 2)
+	retaining.Annotations = map[string]string{RetentionAnnotation: RetentionRetain}
+	orphan := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: testNamespace, Labels: appLabels}}
+	for name, test := range map[string]struct {
+		sts     *appsv1.StatefulSet
+		objects []runtime.Object
+	}{
+		"retain": {sts: retaining},
+		"orphan": {sts: sts, objects: []runtime.Object{orphan}},
+	} {
+		client := newClient()
+		for _, obj := range test.objects {
+			_ = client.Tracker().Add(obj)
+		}
+		if _, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", LastKnownState: test.sts, Client: client}); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+		if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{}); err != nil {
+			t.Errorf("Claim deleted with %s, err: %v", name, err)
+		}
+	}
+}
+
+func TestCleaner_Reconcile_DefaultGracePeriod(t *testing.T) {
+	sts := newStatefulSet("web", 1)
+	sts.Annotations = map[string]string{RetentionAnnotation: RetentionDeleteOnScaleDown}
+	client := fake.NewSimpleClientset(sts, newClaim("data-web-0", appLabels), newClaim("data-web-1", appLabels))
+	c := NewCleaner(CleanerName)
+	result, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", Object: sts, Client: client})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	// The scaled down claim is kept for the default grace period.
+	if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("Scaled down claim deleted within the default grace period, err: %v", err)
+	}
+	if result.RequeueAfter <= DefaultGracePeriod-time.Minute || result.RequeueAfter > DefaultGracePeriod {
+		t.Errorf("Requeue after is incorrect, got: %v, want: %v.", result.RequeueAfter, DefaultGracePeriod)
+	}
+}
+
+func TestCleaner_Reconcile_OptedOut(t *testing.T) {
+	// Removing the cleaner label of a live statefulSet removes it from the cache like a deletion.
+	sts := newStatefulSet("web", 2)
+	controller := true
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: testNamespace, Labels: appLabels, OwnerReferences: []metav1.OwnerReference{{
+		APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web", UID: sts.UID, Controller: &controller,
+	}}}}
+	client := fake.NewSimpleClientset(sts, pod, newClaim("data-web-1", appLabels))
+	c := NewCleaner(CleanerName)
+	if _, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", LastKnownState: sts, Client: client}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("Claim of a live statefulSet deleted, err: %v", err)
+	}
+	// A statefulSet recreated with the same name takes the claims of the deleted one over.
+	recreated := newStatefulSet("web", 2)
+	recreated.UID = "recreated-uid"
+	client = fake.NewSimpleClientset(recreated, newClaim("data-web-1", appLabels))
+	if _, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", LastKnownState: sts, Client: client}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), "data-web-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("Claim of the recreated statefulSet deleted, err: %v", err)
+	}
+}
+
+func TestCleaner_Reconcile_Ordinals(t *testing.T) {
+	sts := newStatefulSet("web", 3)
+	sts.Spec.Ordinals = &appsv1.StatefulSetOrdinals{Start: 5}
+	sts.Annotations = map[string]string{RetentionAnnotation: RetentionDeleteOnScaleDown}
+	client := fake.NewSimpleClientset(sts)
+	for _, name := range []string{"data-web-4", "data-web-5", "data-web-7", "data-web-8"} {
+		_ = client.Tracker().Add(newClaim(name, appLabels))
+	}
+	c := NewCleaner(CleanerName)
+	if _, err := c.Reconcile(context.TODO(), api.Request{Key: "default/web", Object: sts, Client: client}); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	// Only the ordinals at or above start+replicas are scaled down.
+	want := map[string]bool{"data-web-4": false, "data-web-5": false, "data-web-7": false, "data-web-8": true}
+	for name, scaledDown := range want {
+		claim, _ := client.CoreV1().PersistentVolumeClaims(testNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if _, ok := claim.Annotations[ScaledDownAnnotation]; ok != scaledDown {
+			t.Errorf("Claim %s scaled down is incorrect, got: %t, want: %t.", name, ok, scaledDown)
+		}
+	}
+}
+
+func TestCleaner_HandleObject_InvalidAnnotations(t *testing.T) {
+	c := NewCleaner(CleanerName)
+	for key, value := range map[string]string{RetentionAnnotation: "Sometimes", GracePeriodAnnotation: "soon"} {
+		sts := newStatefulSet("web", 1)
+		sts.Annotations = map[string]string{key: value}
+		if err := c.HandleObject(fake.NewSimpleClientset(sts), sts); err == nil {
+			t.Errorf("Expected error for invalid %s annotation, but got no error.", key)
+		}
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	namespace := "apps"
+	options, err := ConfigOptions(config.ControllerSettings{Namespace: &namespace, Settings: map[string]string{"graceperiod": "30m"}})
+	if err != nil {
+		t.Fatalf("ConfigOptions failed with err: %v", err)
+	}
+	c := NewCleaner(CleanerName, options...)
+	if c.Namespace != namespace || c.LabelSelector != DefaultLabelSelector || c.GracePeriod != 30*time.Minute {
+		t.Errorf("Cleaner settings are incorrect, got: %s %s %s.", c.Namespace, c.LabelSelector, c.GracePeriod)
+	}
+	if _, err := ConfigOptions(config.ControllerSettings{Settings: map[string]string{"graceperiod": "soon"}}); err == nil {
+		t.Errorf("Expected error for an invalid grace period, but got no error.")
+	}
+}
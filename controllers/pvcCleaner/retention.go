@@ -0,0 +1,209 @@
+package pvcCleaner
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+// Retention policies set with the RetentionAnnotation on the statefulSet.
+const (
+	// RetentionDelete deletes the claims with the statefulSet. This is the default.
+	RetentionDelete = "Delete"
+	// RetentionRetain keeps the claims.
+	RetentionRetain = "Retain"
+	// RetentionDeleteOnScaleDown deletes the claims with the statefulSet and the claims
+	// of ordinals removed by a scale-down once the grace period has passed.
+	RetentionDeleteOnScaleDown = "DeleteOnScaleDown"
+)
+
+// StatefulSet and claim annotations used by the cleaner.
+const (
+	RetentionAnnotation   = "kontroller/pvc-retention"
+	GracePeriodAnnotation = "kontroller/pvc-grace-period"
+	ScaledDownAnnotation  = "kontroller/scaled-down-at"
+)
+
+// retentionPolicy returns the retention policy annotated on the statefulSet.
+func retentionPolicy(sts *appsv1.StatefulSet) (string, error) {
+	policy, ok := sts.Annotations[RetentionAnnotation]
+	if !ok {
+		return RetentionDelete, nil
+	}
+	switch policy {
+	case RetentionDelete, RetentionRetain, RetentionDeleteOnScaleDown:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid %s annotation %q on statefulSet %s/%s", RetentionAnnotation, policy, sts.Namespace, sts.Name)
+}
+
+// adopt makes the statefulSet own the claim and clears a pending scale-down deletion.
+func adopt(ctx context.Context, client kubernetes.Interface, claim *corev1.PersistentVolumeClaim, sts *appsv1.StatefulSet) error {
+	_, scaledDown := claim.Annotations[ScaledDownAnnotation]
+	if isOwnedBy(claim, sts) && !scaledDown {
+		return nil
+	}
+	if !isOwnedBy(claim, sts) {
+		claim.OwnerReferences = append(claim.OwnerReferences, ownerReference(sts))
+	}
+	delete(claim.Annotations, ScaledDownAnnotation)
+	if _, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Infof("pvc %s/%s adopted by statefulSet %s", claim.Namespace, claim.Name, sts.Name)
+	return nil
+}
+
+// release removes the owner reference to the statefulSet from the claim.
+func release(ctx context.Context, client kubernetes.Interface, claim *corev1.PersistentVolumeClaim, sts *appsv1.StatefulSet) error {
+	if !isOwnedBy(claim, sts) {
+		return nil
+	}
+	refs := claim.OwnerReferences[:0]
+	for _, ref := range claim.OwnerReferences {
+		if ref.UID != sts.UID {
+			refs = append(refs, ref)
+		}
+	}
+	claim.OwnerReferences = refs
+	if _, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Infof("pvc %s/%s released by statefulSet %s", claim.Namespace, claim.Name, sts.Name)
+	return nil
+}
+
+// reclaim marks the claim of a scaled down ordinal and deletes it once the grace period has passed.
+// It returns the remaining grace period while the claim is kept.
+func reclaim(ctx context.Context, client kubernetes.Interface, claim *corev1.PersistentVolumeClaim, sts *appsv1.StatefulSet, gracePeriod time.Duration, now time.Time) (time.Duration, error) {
+	scaledDownAt, err := time.Parse(time.RFC3339, claim.Annotations[ScaledDownAnnotation])
+	if err != nil {
+		if claim.Annotations == nil {
+			claim.Annotations = map[string]string{}
+		}
+		claim.Annotations[ScaledDownAnnotation] = now.Format(time.RFC3339)
+		if _, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, metav1.UpdateOptions{}); err != nil {
+			return 0, err
+		}
+		log.FromContext(ctx).Infof("pvc %s/%s scaled down by statefulSet %s, delete after %s", claim.Namespace, claim.Name, sts.Name, gracePeriod)
+		scaledDownAt = now
+	}
+	if remaining := gracePeriod - now.Sub(scaledDownAt); remaining > 0 {
+		return remaining, nil
+	}
+	err = client.CoreV1().PersistentVolumeClaims(claim.Namespace).Delete(ctx, claim.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &claim.UID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.FromContext(ctx).Infof("pvc %s/%s deleted after scale down of statefulSet %s", claim.Namespace, claim.Name, sts.Name)
+	return 0, nil
+}
+
+// cleanUp deletes the claims of the deleted statefulSet that were not adopted yet, e.g. as it was deleted
+// before the cleaner handled it. The claims are kept if the last known state is unknown, the statefulSet
+// still exists but is no longer selected or was recreated, it retained its claims, or pods of the statefulSet are left that
+// it does not own, i.e. they were orphaned by a deletion with --cascade=orphan or belong to a new
+// statefulSet of the same name.
+func cleanUp(ctx context.Context, client kubernetes.Interface, lastKnownState interface{}) error {
+	sts, ok := lastKnownState.(*appsv1.StatefulSet)
+	if !ok {
+		return nil
+	}
+	if policy, err := retentionPolicy(sts); err != nil || policy == RetentionRetain {
+		return nil
+	}
+	// The statefulSet left the cache without being deleted, e.g. as its cleaner label was removed, or it
+	// was recreated with the same name, whose pods take over the claims.
+	current, err := client.AppsV1().StatefulSets(sts.Namespace).Get(ctx, sts.Name, metav1.GetOptions{})
+	if err == nil {
+		if current.UID == sts.UID {
+			log.FromContext(ctx).Infof("statefulSet %s/%s opted out of the cleaner, pvc kept", sts.Namespace, sts.Name)
+		} else {
+			log.FromContext(ctx).Infof("statefulSet %s/%s recreated, pvc kept", sts.Namespace, sts.Name)
+		}
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	claims, err := listClaims(ctx, client, sts)
+	if err != nil || len(claims) == 0 {
+		return err
+	}
+	orphaned, err := hasForeignPods(ctx, client, sts)
+	if err != nil {
+		return err
+	}
+	if orphaned {
+		log.FromContext(ctx).Infof("pvc of statefulSet %s/%s kept for its orphaned pods", sts.Namespace, sts.Name)
+		return nil
+	}
+	var errs []error
+	for i := range claims {
+		claim := &claims[i]
+		// Adopted claims are deleted by the garbage collector, claims owned by others are kept.
+		if len(claim.OwnerReferences) > 0 {
+			continue
+		}
+		err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Delete(ctx, claim.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &claim.UID},
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("delete pvc %s/%s failed: %v", claim.Namespace, claim.Name, err))
+			continue
+		}
+		log.FromContext(ctx).Infof("pvc %s/%s deleted with statefulSet %s", claim.Namespace, claim.Name, sts.Name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// hasForeignPods reports whether pods of the statefulSet are left that it does not own.
+func hasForeignPods(ctx context.Context, client kubernetes.Interface, sts *appsv1.StatefulSet) (bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+	if err != nil {
+		return false, err
+	}
+	pods, err := client.CoreV1().Pods(sts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return false, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !strings.HasPrefix(pod.Name, sts.Name+"-") {
+			continue
+		}
+		if owner := metav1.GetControllerOf(pod); owner == nil || owner.UID != sts.UID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isOwnedBy reports whether the claim has an owner reference to the statefulSet.
+func isOwnedBy(claim *corev1.PersistentVolumeClaim, sts *appsv1.StatefulSet) bool {
+	for _, ref := range claim.OwnerReferences {
+		if ref.UID == sts.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerReference returns a non-controller owner reference to the statefulSet.
+func ownerReference(sts *appsv1.StatefulSet) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: appsv1.SchemeGroupVersion.String(),
+		Kind:       "StatefulSet",
+		Name:       sts.Name,
+		UID:        sts.UID,
+	}
+}
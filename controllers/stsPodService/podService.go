@@ -0,0 +1,307 @@
+package stsPodService
+
+import (
+	"Kontroller/config"
+	"Kontroller/logging"
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/common"
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"time"
+)
+
+var log *logging.Logging
+
+const (
+	PodServiceName       = "sts-pod-service"
+	DefaultLabelSelector = "kontroller/pod-service=true"
+)
+
+func init() {
+	log = logging.NewLogging(PodServiceName)
+}
+
+// PodService creates a service for every statefulSet pod, selecting the pod by its
+// statefulset.kubernetes.io/pod-name label. The service is owned by the pod and templated
+// by the annotations of the statefulSet.
+type PodService struct {
+	Name          string
+	Resource      string
+	Object        runtime.Object
+	Namespace     string
+	LabelSelector string
+	ServiceType   corev1.ServiceType
+}
+
+func (p *PodService) ControllerName() string {
+	return p.Name
+}
+
+func (p *PodService) ControlObject() runtime.Object {
+	return p.Object
+}
+
+func (p *PodService) ControlResourceName() string {
+	return p.Resource
+}
+
+func (p *PodService) ControlNamespace() string {
+	return p.Namespace
+}
+
+func (p *PodService) ControlLabelSelector() string {
+	return p.LabelSelector
+}
+
+// Watch returns the service and statefulSet informers, adding the pods to the queue whose service drifted or
+// was deleted, and the pods of a statefulSet whose templating annotations changed, so that drift is reconciled
+// without waiting for a pod event.
+func (p *PodService) Watch(client kubernetes.Interface, queue workqueue.RateLimitingInterface, resyncPeriod time.Duration) []cache.Controller {
+	services := &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Services(p.Namespace).List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Services(p.Namespace).Watch(ctx, options)
+		},
+	}
+	statefulSets := &cache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.AppsV1().StatefulSets(p.Namespace).List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return client.AppsV1().StatefulSets(p.Namespace).Watch(ctx, options)
+		},
+	}
+	enqueueOwner := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		service, ok := obj.(*corev1.Service)
+		if !ok {
+			return
+		}
+		if ref := metav1.GetControllerOf(service); ref != nil && ref.Kind == "Pod" {
+			queue.Add(service.Namespace + "/" + ref.Name)
+		}
+	}
+	selector, err := labels.Parse(p.LabelSelector)
+	if err != nil {
+		selector = labels.Nothing()
+	}
+	enqueuePods := func(obj interface{}) {
+		sts, ok := obj.(*appsv1.StatefulSet)
+		if !ok || !selector.Matches(labels.Set(sts.Spec.Template.Labels)) {
+			return
+		}
+		for _, name := range podNames(sts) {
+			queue.Add(sts.Namespace + "/" + name)
+		}
+	}
+	_, serviceInformer := cache.NewIndexerInformer(services, &corev1.Service{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) { enqueueOwner(newObj) },
+		DeleteFunc: enqueueOwner,
+	}, cache.Indexers{})
+	_, statefulSetInformer := cache.NewIndexerInformer(statefulSets, &appsv1.StatefulSet{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueuePods,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, cur := oldObj.(*appsv1.StatefulSet), newObj.(*appsv1.StatefulSet)
+			// Resyncs and changes of the templating annotations only, skipping status updates.
+			if old.ResourceVersion == cur.ResourceVersion || !equality.Semantic.DeepEqual(old.Annotations, cur.Annotations) {
+				enqueuePods(newObj)
+			}
+		},
+	}, cache.Indexers{})
+	return []cache.Controller{serviceInformer, statefulSetInformer}
+}
+
+// podNames returns the names of the pods of the statefulSet, including the ones of a scale-down in progress.
+func podNames(sts *appsv1.StatefulSet) []string {
+	replicas := sts.Status.Replicas
+	if sts.Spec.Replicas != nil && *sts.Spec.Replicas > replicas {
+		replicas = *sts.Spec.Replicas
+	}
+	start := int32(0)
+	if sts.Spec.Ordinals != nil {
+		start = sts.Spec.Ordinals.Start
+	}
+	names := make([]string, 0, replicas)
+	for i := int32(0); i < replicas; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", sts.Name, start+i))
+	}
+	return names
+}
+
+// HandleObject creates or reconciles the service of a statefulSet pod, see Reconcile.
+func (p *PodService) HandleObject(client kubernetes.Interface, object interface{}) error {
+	return p.sync(context.TODO(), client, object)
+}
+
+// Reconcile creates the service of a statefulSet pod from the template annotated on the
+// statefulSet, and reconciles drift of an existing service back to the template. Pods are also
+// reconciled on events of their service and statefulSet, see Watch. Deletions are left to the
+// garbage collector, as the service is owned by the pod.
+func (p *PodService) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	if req.Object == nil {
+		return api.Result{}, nil
+	}
+	return api.Result{}, p.sync(ctx, req.Client, req.Object)
+}
+
+// sync creates or reconciles the service of the pod.
+func (p *PodService) sync(ctx context.Context, client kubernetes.Interface, object interface{}) error {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T", object)
+	}
+	if pod.DeletionTimestamp != nil || !isStatefulSetPod(pod) {
+		return nil
+	}
+	sts, err := client.AppsV1().StatefulSets(pod.Namespace).Get(ctx, metav1.GetControllerOf(pod).Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The statefulSet is being deleted in the background, its pods follow.
+		log.FromContext(ctx).Debugf("statefulSet of pod %s/%s not found, service skipped", pod.Namespace, pod.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	desired, err := p.desiredService(pod, sts)
+	if err != nil {
+		return err
+	}
+	if len(desired.Spec.Ports) == 0 {
+		log.FromContext(ctx).Warnf("pod %s/%s exposes no container port, service skipped", pod.Namespace, pod.Name)
+		return nil
+	}
+	existing, err := client.CoreV1().Services(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if _, err := client.CoreV1().Services(pod.Namespace).Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Infof("service %s/%s created for pod %s", desired.Namespace, desired.Name, pod.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ref := metav1.GetControllerOf(existing)
+	if ref == nil || ref.Kind != "Pod" || ref.Name != pod.Name {
+		log.FromContext(ctx).Warnf("service %s/%s exists and is not owned by pod %s, skipped", existing.Namespace, existing.Name, pod.Name)
+		return nil
+	}
+	service := reconcileService(existing, desired)
+	if equality.Semantic.DeepEqual(existing, service) {
+		return nil
+	}
+	if _, err := client.CoreV1().Services(service.Namespace).Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Infof("service %s/%s reconciled for pod %s", service.Namespace, service.Name, pod.Name)
+	return nil
+}
+
+// servicePorts returns a service port for every container port of the pod.
+func servicePorts(pod *corev1.Pod) []corev1.ServicePort {
+	var ports []corev1.ServicePort
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			name := port.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", strings.ToLower(string(protocolOf(port))), port.ContainerPort)
+			}
+			ports = append(ports, corev1.ServicePort{
+				Name:       name,
+				Protocol:   protocolOf(port),
+				Port:       port.ContainerPort,
+				TargetPort: intstr.FromInt32(port.ContainerPort),
+			})
+		}
+	}
+	return ports
+}
+
+// protocolOf returns the protocol of the container port, TCP if unset.
+func protocolOf(port corev1.ContainerPort) corev1.Protocol {
+	if port.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// isStatefulSetPod reports whether the pod is controlled by a statefulSet.
+func isStatefulSetPod(pod *corev1.Pod) bool {
+	ref := metav1.GetControllerOf(pod)
+	return ref != nil && ref.Kind == "StatefulSet" && pod.Labels[appsv1.StatefulSetPodNameLabel] == pod.Name
+}
+
+type Option func(podService *PodService)
+
+func Namespace(n string) Option {
+	return func(podService *PodService) {
+		podService.Namespace = n
+	}
+}
+
+func LabelSelector(l string) Option {
+	return func(podService *PodService) {
+		podService.LabelSelector = strings.ReplaceAll(strings.ToLower(l), " ", "")
+	}
+}
+
+// ServiceType sets the default type of the created services, overridden by the
+// ServiceTypeAnnotation of the statefulSet.
+func ServiceType(t corev1.ServiceType) Option {
+	return func(podService *PodService) {
+		podService.ServiceType = t
+	}
+}
+
+// ConfigOptions returns the options of the pod service settings of config.yaml.
+// The serviceType setting is ClusterIP, NodePort or LoadBalancer.
+func ConfigOptions(settings config.ControllerSettings) ([]Option, error) {
+	var options []Option
+	if settings.Namespace != nil {
+		options = append(options, Namespace(*settings.Namespace))
+	}
+	if settings.LabelSelector != nil {
+		options = append(options, LabelSelector(*settings.LabelSelector))
+	}
+	if value, ok := settings.Settings["servicetype"]; ok {
+		switch serviceType := corev1.ServiceType(value); serviceType {
+		case corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+			options = append(options, ServiceType(serviceType))
+		default:
+			return nil, fmt.Errorf("invalid serviceType setting %q", value)
+		}
+	}
+	return options, nil
+}
+
+func NewPodService(name string, options ...Option) *PodService {
+	p := &PodService{
+		Name:          name,
+		Resource:      common.Pods,
+		Object:        &corev1.Pod{},
+		Namespace:     corev1.NamespaceAll,
+		LabelSelector: DefaultLabelSelector,
+		ServiceType:   corev1.ServiceTypeClusterIP,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
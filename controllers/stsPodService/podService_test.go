@@ -0,0 +1,248 @@
+package stsPodService
+
+import (
+	"Kontroller/config"
+	"Kontroller/pkg/api"
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testNamespace = "default"
+
+func newPod(name string, uid types.UID) *corev1.Pod {
+	controller := true
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       uid,
+			Labels:    map[string]string{appsv1.StatefulSetPodNameLabel: name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "StatefulSet", Name: "kafka", UID: "kafka-uid", Controller: &controller,
+			}},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "broker",
+			Ports: []corev1.ContainerPort{{Name: "kafka", ContainerPort: 9092}, {ContainerPort: 9999, Protocol: corev1.ProtocolUDP}},
+		}}},
+	}
+}
+
+func newStatefulSet(annotations map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: testNamespace, UID: "kafka-uid", Annotations: annotations}}
+}
+
+func TestPodService_HandleObject(t *testing.T) {
+	client := fake.NewSimpleClientset(newStatefulSet(nil))
+	p := NewPodService(PodServiceName, ServiceType(corev1.ServiceTypeNodePort))
+	pod := newPod("kafka-0", "pod-uid")
+	if err := p.HandleObject(client, pod); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Service not created: %v", err)
+	}
+	if service.Spec.Type != corev1.ServiceTypeNodePort {
+		t.Errorf("Service type is incorrect, got: %s, want: %s.", service.Spec.Type, corev1.ServiceTypeNodePort)
+	}
+	if got := service.Spec.Selector[appsv1.StatefulSetPodNameLabel]; got != "kafka-0" {
+		t.Errorf("Service selector is incorrect, got: %s, want: %s.", got, "kafka-0")
+	}
+	if len(service.Spec.Ports) != 2 || service.Spec.Ports[1].Name != "udp-9999" {
+		t.Errorf("Service ports are incorrect, got: %v.", service.Spec.Ports)
+	}
+	if ref := metav1.GetControllerOf(service); ref == nil || ref.UID != pod.UID {
+		t.Errorf("Service is not owned by the pod, got: %v.", service.OwnerReferences)
+	}
+	// A pod recreated with the same name takes over the service.
+	recreated := newPod("kafka-0", "new-pod-uid")
+	if err := p.HandleObject(client, recreated); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	service, _ = client.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-0", metav1.GetOptions{})
+	if ref := metav1.GetControllerOf(service); ref == nil || ref.UID != recreated.UID {
+		t.Errorf("Service is not owned by the recreated pod, got: %v.", service.OwnerReferences)
+	}
+}
+
+func TestPodService_HandleObject_Skipped(t *testing.T) {
+	foreign := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kafka-0", Namespace: testNamespace}}
+	client := fake.NewSimpleClientset(newStatefulSet(nil), foreign)
+	p := NewPodService(PodServiceName)
+	if err := p.HandleObject(client, newPod("kafka-0", "pod-uid")); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	service, _ := client.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-0", metav1.GetOptions{})
+	if len(service.OwnerReferences) != 0 {
+		t.Errorf("Service not created by the controller was taken over.")
+	}
+	standalone := newPod("standalone", "standalone-uid")
+	standalone.OwnerReferences = nil
+	if err := p.HandleObject(client, standalone); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	if _, err := client.CoreV1().Services(testNamespace).Get(context.TODO(), "standalone", metav1.GetOptions{}); err == nil {
+		t.Errorf("Service created for a pod not owned by a statefulSet.")
+	}
+	// Pods of a statefulSet deleted in the background are skipped without an error.
+	orphaned := fake.NewSimpleClientset()
+	if err := p.HandleObject(orphaned, newPod("kafka-1", "pod-uid")); err != nil {
+		t.Errorf("Pod of a deleted statefulSet failed with err: %v", err)
+	}
+	if _, err := orphaned.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-1", metav1.GetOptions{}); err == nil {
+		t.Errorf("Service created for a pod of a deleted statefulSet.")
+	}
+}
+
+func TestPodService_HandleObject_Template(t *testing.T) {
+	sts := newStatefulSet(map[string]string{
+		ServiceTypeAnnotation: string(corev1.ServiceTypeLoadBalancer),
+		PortsAnnotation:       "kafka",
+		NodePortsAnnotation:   "kafka=30000",
+		LabelsAnnotation:      `{"team":"streaming"}`,
+		AnnotationsAnnotation: `{"service.beta.kubernetes.io/aws-load-balancer-type":"nlb"}`,
+	})
+	client := fake.NewSimpleClientset(sts)
+	p := NewPodService(PodServiceName)
+	if err := p.HandleObject(client, newPod("kafka-2", "pod-uid")); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Service not created: %v", err)
+	}
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		t.Errorf("Service type is incorrect, got: %s, want: %s.", service.Spec.Type, corev1.ServiceTypeLoadBalancer)
+	}
+	if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].NodePort != 30002 {
+		t.Fatalf("Service ports are incorrect, got: %v.", service.Spec.Ports)
+	}
+	if service.Labels["team"] != "streaming" || service.Annotations["service.beta.kubernetes.io/aws-load-balancer-type"] != "nlb" {
+		t.Errorf("Service labels or annotations are incorrect, got: %v, %v.", service.Labels, service.Annotations)
+	}
+	// Drift is reconciled back to the template, foreign labels are kept.
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	service.Spec.Ports[0].NodePort = 0
+	service.Labels["owner"] = "someone"
+	_, _ = client.CoreV1().Services(testNamespace).Update(context.TODO(), service, metav1.UpdateOptions{})
+	if err := p.HandleObject(client, newPod("kafka-2", "pod-uid")); err != nil {
+		t.Fatalf("HandleObject failed: %v", err)
+	}
+	service, _ = client.CoreV1().Services(testNamespace).Get(context.TODO(), "kafka-2", metav1.GetOptions{})
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || service.Spec.Ports[0].NodePort != 30002 {
+		t.Errorf("Service drift was not reconciled, got: %s %v.", service.Spec.Type, service.Spec.Ports)
+	}
+	if service.Labels["owner"] != "someone" {
+		t.Errorf("Foreign service label was removed.")
+	}
+}
+
+func TestPodService_HandleObject_InvalidTemplate(t *testing.T) {
+	p := NewPodService(PodServiceName)
+	for key, value := range map[string]string{
+		ServiceTypeAnnotation: "ExternalName",
+		NodePortsAnnotation:   "30000",
+		LabelsAnnotation:      "team=streaming",
+	} {
+		sts := newStatefulSet(map[string]string{ServiceTypeAnnotation: string(corev1.ServiceTypeNodePort)})
+		sts.Annotations[key] = value
+		if err := p.HandleObject(fake.NewSimpleClientset(sts), newPod("kafka-0", "pod-uid")); err == nil {
+			t.Errorf("Expected error for invalid %s annotation, but got no error.", key)
+		}
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	options, err := ConfigOptions(config.ControllerSettings{Settings: map[string]string{"servicetype": "NodePort"}})
+	if err != nil {
+		t.Fatalf("ConfigOptions failed with err: %v", err)
+	}
+	if p := NewPodService(PodServiceName, options...); p.ServiceType != corev1.ServiceTypeNodePort {
+		t.Errorf("Service type is incorrect, got: %s, want: %s.", p.ServiceType, corev1.ServiceTypeNodePort)
+	}
+	if _, err := ConfigOptions(config.ControllerSettings{Settings: map[string]string{"servicetype": "External"}}); err == nil {
+		t.Errorf("Expected error for an invalid service type, but got no error.")
+	}
+}
+
+func TestPodService_Reconcile(t *testing.T) {
+	p := NewPodService(PodServiceName)
+	if reconciler := api.AsReconciler(p); reconciler != api.Reconciler(p) {
+		t.Errorf("Pod service is adapted instead of reconciling with the context.")
+	}
+	if _, err := p.Reconcile(context.Background(), api.Request{Key: "default/web-0", Client: fake.NewSimpleClientset()}); err != nil {
+		t.Errorf("Deleted pod reconcile failed with err: %v", err)
+	}
+}
+
+// nextKeys returns the keys added to the queue within a second.
+func nextKeys(queue workqueue.RateLimitingInterface) map[string]bool {
+	keys := map[string]bool{}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for queue.Len() > 0 {
+			key, _ := queue.Get()
+			keys[key.(string)] = true
+			queue.Done(key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return keys
+}
+
+func TestPodService_Watch(t *testing.T) {
+	replicas := int32(2)
+	sts := newStatefulSet(map[string]string{ServiceTypeAnnotation: "NodePort"})
+	sts.Spec.Replicas = &replicas
+	sts.Spec.Template.Labels = map[string]string{"kontroller/pod-service": "true"}
+	unlabelled := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "zookeeper", Namespace: testNamespace}, Spec: appsv1.StatefulSetSpec{Replicas: &replicas}}
+	controller := true
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kafka-0", Namespace: testNamespace, OwnerReferences: []metav1.OwnerReference{{
+		APIVersion: "v1", Kind: "Pod", Name: "kafka-0", UID: "kafka-0-uid", Controller: &controller,
+	}}}}
+	client := fake.NewSimpleClientset(sts, unlabelled, service)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	stopper := make(chan struct{})
+	defer close(stopper)
+	for _, informer := range NewPodService(PodServiceName).Watch(client, queue, 0) {
+		go informer.Run(stopper)
+		cache.WaitForCacheSync(stopper, informer.HasSynced)
+	}
+	if got, want := nextKeys(queue), map[string]bool{"default/kafka-0": true, "default/kafka-1": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pods of the statefulSets are incorrect, got: %v, want: %v.", got, want)
+	}
+	// A drifted or deleted service requeues its pod.
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	_, _ = client.CoreV1().Services(testNamespace).Update(context.TODO(), service, metav1.UpdateOptions{})
+	if got, want := nextKeys(queue), map[string]bool{"default/kafka-0": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pods of the updated service are incorrect, got: %v, want: %v.", got, want)
+	}
+	_ = client.CoreV1().Services(testNamespace).Delete(context.TODO(), "kafka-0", metav1.DeleteOptions{})
+	if got, want := nextKeys(queue), map[string]bool{"default/kafka-0": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pods of the deleted service are incorrect, got: %v, want: %v.", got, want)
+	}
+	// A status update of the statefulSet is skipped, a template change requeues its pods.
+	sts.ResourceVersion = "2"
+	sts.Status.ReadyReplicas = 1
+	_, _ = client.AppsV1().StatefulSets(testNamespace).UpdateStatus(context.TODO(), sts, metav1.UpdateOptions{})
+	if got := nextKeys(queue); len(got) != 0 {
+		t.Errorf("Pods requeued on a status update, got: %v.", got)
+	}
+	sts.ResourceVersion = "3"
+	sts.Annotations[ServiceTypeAnnotation] = "LoadBalancer"
+	_, _ = client.AppsV1().StatefulSets(testNamespace).Update(context.TODO(), sts, metav1.UpdateOptions{})
+	if got, want := nextKeys(queue), map[string]bool{"default/kafka-0": true, "default/kafka-1": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pods of the updated statefulSet are incorrect, got: %v, want: %v.", got, want)
+	}
+}
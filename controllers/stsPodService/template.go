@@ -0,0 +1,183 @@
+package stsPodService
+
+import (
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"strings"
+)
+
+// StatefulSet annotations templating the pod services.
+const (
+	// ServiceTypeAnnotation sets the service type: ClusterIP, NodePort or LoadBalancer.
+	ServiceTypeAnnotation = "kontroller/pod-service-type"
+	// PortsAnnotation lists the comma separated container port names or numbers to expose, all by default.
+	PortsAnnotation = "kontroller/pod-service-ports"
+	// NodePortsAnnotation sets the node port base of the exposed ports as "name=30000,9999=31000",
+	// or as "30000" if a single port is exposed. The node port of a pod is the base plus its ordinal.
+	NodePortsAnnotation = "kontroller/pod-service-node-ports"
+	// LabelsAnnotation holds a JSON object of extra labels added to the services.
+	LabelsAnnotation = "kontroller/pod-service-labels"
+	// AnnotationsAnnotation holds a JSON object of extra annotations added to the services,
+	// e.g. cloud load balancer hints.
+	AnnotationsAnnotation = "kontroller/pod-service-annotations"
+)
+
+// desiredService renders the service of the pod from the template annotated on its statefulSet.
+func (p *PodService) desiredService(pod *corev1.Pod, sts *appsv1.StatefulSet) (*corev1.Service, error) {
+	serviceType := p.ServiceType
+	if value, ok := sts.Annotations[ServiceTypeAnnotation]; ok {
+		serviceType = corev1.ServiceType(value)
+		switch serviceType {
+		case corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		default:
+			return nil, fmt.Errorf("invalid %s annotation %q on statefulSet %s/%s", ServiceTypeAnnotation, value, sts.Namespace, sts.Name)
+		}
+	}
+	ports := servicePorts(pod)
+	if value, ok := sts.Annotations[PortsAnnotation]; ok {
+		ports = selectPorts(ports, splitList(value))
+	}
+	if value, ok := sts.Annotations[NodePortsAnnotation]; ok && serviceType != corev1.ServiceTypeClusterIP {
+		ordinal, err := podOrdinal(pod)
+		if err != nil {
+			return nil, err
+		}
+		if err := assignNodePorts(ports, value, ordinal); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on statefulSet %s/%s: %v", NodePortsAnnotation, sts.Namespace, sts.Name, err)
+		}
+	}
+	labels, err := jsonMap(sts.Annotations, LabelsAnnotation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on statefulSet %s/%s: %v", LabelsAnnotation, sts.Namespace, sts.Name, err)
+	}
+	annotations, err := jsonMap(sts.Annotations, AnnotationsAnnotation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on statefulSet %s/%s: %v", AnnotationsAnnotation, sts.Namespace, sts.Name, err)
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			Labels:          labels,
+			Annotations:     annotations,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(pod, corev1.SchemeGroupVersion.WithKind("Pod"))},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     serviceType,
+			Selector: map[string]string{appsv1.StatefulSetPodNameLabel: pod.Name},
+			Ports:    ports,
+		},
+	}, nil
+}
+
+// reconcileService copies the desired fields onto the existing service. Labels and annotations
+// are merged, and node ports allocated by the cluster are kept unless fixed by the template.
+func reconcileService(existing, desired *corev1.Service) *corev1.Service {
+	service := existing.DeepCopy()
+	if service.Labels == nil && len(desired.Labels) > 0 {
+		service.Labels = map[string]string{}
+	}
+	for k, v := range desired.Labels {
+		service.Labels[k] = v
+	}
+	if service.Annotations == nil && len(desired.Annotations) > 0 {
+		service.Annotations = map[string]string{}
+	}
+	for k, v := range desired.Annotations {
+		service.Annotations[k] = v
+	}
+	service.OwnerReferences = desired.OwnerReferences
+	ports := make([]corev1.ServicePort, len(desired.Spec.Ports))
+	copy(ports, desired.Spec.Ports)
+	if desired.Spec.Type != corev1.ServiceTypeClusterIP {
+		for i := range ports {
+			for _, port := range existing.Spec.Ports {
+				if ports[i].NodePort == 0 && port.Name == ports[i].Name {
+					ports[i].NodePort = port.NodePort
+				}
+			}
+		}
+	}
+	service.Spec.Type = desired.Spec.Type
+	service.Spec.Selector = desired.Spec.Selector
+	service.Spec.Ports = ports
+	return service
+}
+
+// selectPorts keeps the service ports whose container port name or number is listed.
+func selectPorts(ports []corev1.ServicePort, selected []string) []corev1.ServicePort {
+	var kept []corev1.ServicePort
+	for _, port := range ports {
+		for _, s := range selected {
+			if s == port.Name || s == strconv.Itoa(int(port.Port)) {
+				kept = append(kept, port)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// assignNodePorts sets the node port of the ports to their base plus the ordinal.
+func assignNodePorts(ports []corev1.ServicePort, value string, ordinal int) error {
+	if base, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if len(ports) != 1 {
+			return fmt.Errorf("a single node port base needs exactly one exposed port, got %d", len(ports))
+		}
+		ports[0].NodePort = int32(base + ordinal)
+		return nil
+	}
+	for _, entry := range splitList(value) {
+		name, baseValue, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("entry %q is not name=base", entry)
+		}
+		base, err := strconv.Atoi(strings.TrimSpace(baseValue))
+		if err != nil {
+			return fmt.Errorf("entry %q has no numeric base", entry)
+		}
+		for i := range ports {
+			if strings.TrimSpace(name) == ports[i].Name || strings.TrimSpace(name) == strconv.Itoa(int(ports[i].Port)) {
+				ports[i].NodePort = int32(base + ordinal)
+			}
+		}
+	}
+	return nil
+}
+
+// podOrdinal returns the ordinal of a statefulSet pod from its name.
+func podOrdinal(pod *corev1.Pod) (int, error) {
+	ordinal, err := strconv.Atoi(pod.Name[strings.LastIndex(pod.Name, "-")+1:])
+	if err != nil {
+		return 0, fmt.Errorf("pod %s/%s has no ordinal", pod.Namespace, pod.Name)
+	}
+	return ordinal, nil
+}
+
+// jsonMap decodes the annotation holding a JSON object of strings.
+func jsonMap(annotations map[string]string, key string) (map[string]string, error) {
+	value, ok := annotations[key]
+	if !ok {
+		return nil, nil
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// splitList splits a comma separated list, dropping blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"Kontroller/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Levels represents the global log level and the per-prefix overrides
+type Levels struct {
+	Level    int32            `json:"level"`
+	Prefixes map[string]int32 `json:"prefixes,omitempty"`
+}
+
+var (
+	levelsMu sync.RWMutex
+	levels   = Levels{Level: LevelInfo, Prefixes: map[string]int32{}}
+)
+
+// clampLevel keeps the level within the range of the log levels
+func clampLevel(lvl int32) int32 {
+	if lvl < LevelFatal {
+		return LevelFatal
+	}
+	if lvl > LevelDebug {
+		return LevelDebug
+	}
+	return lvl
+}
+
+// validLevel returns an error if the level is not one of the log levels
+func validLevel(lvl int32) error {
+	if lvl < LevelFatal || lvl > LevelDebug {
+		return fmt.Errorf("invalid log level %d, must be between %d and %d", lvl, LevelFatal, LevelDebug)
+	}
+	return nil
+}
+
+// GetLevels returns a copy of the current log levels
+func GetLevels() Levels {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	prefixes := make(map[string]int32, len(levels.Prefixes))
+	for prefix, lvl := range levels.Prefixes {
+		prefixes[prefix] = lvl
+	}
+	return Levels{Level: levels.Level, Prefixes: prefixes}
+}
+
+// SetLevel sets the global log level, which is also the klog verbosity of client-go
+func SetLevel(lvl int32) error {
+	if err := validLevel(lvl); err != nil {
+		return err
+	}
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	levels.Level = lvl
+	return flag.CommandLine.Set("v", strconv.Itoa(int(loggingLevel[lvl])))
+}
+
+// SetPrefixLevel overrides the log level of the loggings with the prefix, a zero level removes the override
+func SetPrefixLevel(prefix string, lvl int32) error {
+	if lvl != 0 {
+		if err := validLevel(lvl); err != nil {
+			return err
+		}
+	}
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	if lvl == 0 {
+		delete(levels.Prefixes, strings.ToLower(prefix))
+		return nil
+	}
+	levels.Prefixes[strings.ToLower(prefix)] = lvl
+	return nil
+}
+
+// applyConfig sets the log format and levels from the log settings, out of range levels are clamped
+func applyConfig(cfg config.Log) {
+	setFormat(cfg.Format)
+	_ = SetLevel(clampLevel(cfg.Level))
+	prefixes := make(map[string]int32, len(cfg.Prefixes))
+	for prefix, lvl := range cfg.Prefixes {
+		prefixes[strings.ToLower(prefix)] = clampLevel(lvl)
+	}
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	levels.Prefixes = prefixes
+}
+
+// levelOf returns the log level of the prefix
+func levelOf(prefix string) int32 {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	if lvl, ok := levels.Prefixes[strings.ToLower(prefix)]; ok {
+		return lvl
+	}
+	return levels.Level
+}
+
+// Handler returns the http handler of the log levels.
+// GET returns the levels, PUT sets the levels given as a JSON Levels object.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var update Levels
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, fmt.Sprintf("decode levels err with: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := setLevels(update); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetLevels())
+	})
+}
+
+// setLevels validates then sets the global level if given and the prefix levels
+func setLevels(update Levels) error {
+	if update.Level != 0 {
+		if err := validLevel(update.Level); err != nil {
+			return err
+		}
+	}
+	for prefix, lvl := range update.Prefixes {
+		if lvl != 0 {
+			if err := validLevel(lvl); err != nil {
+				return fmt.Errorf("prefix %s: %v", prefix, err)
+			}
+		}
+	}
+	if update.Level != 0 {
+		if err := SetLevel(update.Level); err != nil {
+			return err
+		}
+	}
+	for prefix, lvl := range update.Prefixes {
+		if err := SetPrefixLevel(prefix, lvl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
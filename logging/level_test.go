@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"Kontroller/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetPrefixLevel(t *testing.T) {
+	defer applyConfig(config.Cfg.Log)
+	if err := SetLevel(LevelInfo); err != nil {
+		t.Fatalf("SetLevel failed with err: %v", err)
+	}
+	if err := SetPrefixLevel("Reloader", LevelDebug); err != nil {
+		t.Fatalf("SetPrefixLevel failed with err: %v", err)
+	}
+	if !NewLogging("reloader").enabled(LevelDebug) {
+		t.Errorf("Debug logs of the overridden prefix are not enabled.")
+	}
+	if NewLogging("manager").enabled(LevelDebug) {
+		t.Errorf("Debug logs of other prefixes are enabled.")
+	}
+	if err := SetPrefixLevel("reloader", 0); err != nil {
+		t.Fatalf("SetPrefixLevel failed with err: %v", err)
+	}
+	if NewLogging("reloader").enabled(LevelDebug) {
+		t.Errorf("Debug logs of the prefix are enabled after the override is removed.")
+	}
+	if err := SetPrefixLevel("reloader", 9); err == nil {
+		t.Errorf("Expected error when setting an invalid level, but got no error.")
+	}
+}
+func TestApplyConfig(t *testing.T) {
+	defer applyConfig(config.Cfg.Log)
+	applyConfig(config.Log{Level: 9, Prefixes: map[string]int32{"reloader": 2}})
+	levels := GetLevels()
+	if levels.Level != LevelDebug {
+		t.Errorf("Level is incorrect, got: %d, want: %d.", levels.Level, LevelDebug)
+	}
+	if levels.Prefixes["reloader"] != LevelError {
+		t.Errorf("Prefix level is incorrect, got: %d, want: %d.", levels.Prefixes["reloader"], LevelError)
+	}
+}
+func TestHandler(t *testing.T) {
+	defer applyConfig(config.Cfg.Log)
+	handler := Handler()
+	put := httptest.NewRecorder()
+	handler.ServeHTTP(put, httptest.NewRequest(http.MethodPut, "/debug/loglevel", strings.NewReader(`{"level": 3, "prefixes": {"reloader": 5}}`)))
+	if put.Code != http.StatusOK {
+		t.Errorf("PUT status is incorrect, got: %d, want: %d.", put.Code, http.StatusOK)
+	}
+	get := httptest.NewRecorder()
+	handler.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/debug/loglevel", nil))
+	if want := `{"level":3,"prefixes":{"reloader":5}}`; strings.TrimSpace(get.Body.String()) != want {
+		t.Errorf("GET body is incorrect, got: %s, want: %s.", get.Body.String(), want)
+	}
+	invalid := httptest.NewRecorder()
+	handler.ServeHTTP(invalid, httptest.NewRequest(http.MethodPut, "/debug/loglevel", strings.NewReader(`{"level": 3, "prefixes": {"reloader": 7}}`)))
+	if invalid.Code != http.StatusBadRequest {
+		t.Errorf("Invalid PUT status is incorrect, got: %d, want: %d.", invalid.Code, http.StatusBadRequest)
+	}
+	if GetLevels().Prefixes["reloader"] != LevelDebug {
+		t.Errorf("Prefix level is changed by an invalid PUT, got: %d, want: %d.", GetLevels().Prefixes["reloader"], LevelDebug)
+	}
+	post := httptest.NewRecorder()
+	handler.ServeHTTP(post, httptest.NewRequest(http.MethodPost, "/debug/loglevel", nil))
+	if post.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status is incorrect, got: %d, want: %d.", post.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -2,10 +2,14 @@ package logging
 
 import (
 	"Kontroller/config"
-	"flag"
+	"context"
 	"fmt"
+	"github.com/go-logr/logr/funcr"
+	"io"
 	"k8s.io/klog/v2"
-	"strconv"
+	"os"
+	"strings"
+	"sync/atomic"
 )
 
 // Log level constants
@@ -17,6 +21,12 @@ const (
 	LevelDebug
 )
 
+// Log output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 // Map of log levels to klog.Level
 var loggingLevel = map[int32]klog.Level{
 	LevelFatal:   klog.Level(1),
@@ -25,56 +35,217 @@ var loggingLevel = map[int32]klog.Level{
 	LevelInfo:    klog.Level(4),
 	LevelDebug:   klog.Level(5),
 }
-var level klog.Level
+
+// Map of log levels to their names
+var levelName = map[int32]string{
+	LevelFatal:   "FATAL",
+	LevelError:   "ERROR",
+	LevelWarning: "WARN",
+	LevelInfo:    "INFO",
+	LevelDebug:   "DEBUG",
+}
+
+// structured is true if logs are written as JSON objects
+var structured atomic.Bool
+
+// jsonOutput is the writer of the JSON logs, replaced by tests
+var jsonOutput io.Writer = os.Stderr
 
 // Initialize klog
 func init() {
 	klog.InitFlags(nil)
-	// Get log level
-	level = loggingLevel[config.Cfg.Log.Level]
-	// Ensure log level is within range
-	if level < loggingLevel[LevelFatal] {
-		level = loggingLevel[LevelFatal]
+	// Set the log levels and format, and update them when the configuration changes
+	applyConfig(config.Cfg.Log)
+	config.OnChange(func(_, cfg config.Config) {
+		applyConfig(cfg.Log)
+	})
+}
+
+// setFormat routes klog, and so client-go, through a JSON logger if the format is json
+func setFormat(format string) {
+	json := strings.ToLower(format) == FormatJSON
+	if structured.Swap(json) == json {
+		return
+	}
+	if !json {
+		klog.ClearLogger()
+		return
 	}
-	if level > loggingLevel[LevelDebug] {
-		level = loggingLevel[LevelDebug]
+	verbosityKey := "v"
+	klog.SetLogger(funcr.NewJSON(func(obj string) {
+		_, _ = fmt.Fprintln(jsonOutput, obj)
+	}, funcr.Options{
+		LogTimestamp:       true,
+		LogCaller:          funcr.All,
+		LogInfoLevel:       &verbosityKey,
+		Verbosity:          int(loggingLevel[LevelDebug]),
+		RenderBuiltinsHook: dropEmptyLogger,
+	}))
+}
+
+// dropEmptyLogger removes the empty logger name of the JSON logger, the Logging prefix is logged instead
+func dropEmptyLogger(kvList []interface{}) []interface{} {
+	if len(kvList) >= 2 && kvList[0] == "logger" && kvList[1] == "" {
+		return kvList[2:]
 	}
-	// Set klog log level
-	_ = flag.CommandLine.Set("v", strconv.Itoa(int(level)))
+	return kvList
 }
 
 // Logging struct
 type Logging struct {
-	prefix string     // Log prefix
-	level  klog.Level // Log level
+	prefix string        // Log prefix
+	values []interface{} // Key/value pairs added to every structured log
+}
+
+// ExitFunc is called with the exit code after a fatal log, by default flushing the logs and exiting.
+// Tests may replace it to intercept exits.
+var ExitFunc = func(code int) {
+	klog.FlushAndExit(klog.ExitFlushTimeout, code)
 }
 
 // Debugf method, output DEBUG level log
 func (l *Logging) Debugf(format string, args ...interface{}) {
-	klog.V(loggingLevel[LevelDebug]).Infof("[DEBUG][%s]%s", l.prefix, fmt.Sprintf(format, args...))
+	l.printf(LevelDebug, format, args...)
 }
 
 // Infof method, output INFO level log
 func (l *Logging) Infof(format string, args ...interface{}) {
-	klog.V(loggingLevel[LevelInfo]).Infof("[INFO][%s]%s", l.prefix, fmt.Sprintf(format, args...))
+	l.printf(LevelInfo, format, args...)
 }
 
-// Warnf method, output WARN level log
+// Warnf method, output WARN level log to the warning stream
 func (l *Logging) Warnf(format string, args ...interface{}) {
-	klog.V(loggingLevel[LevelWarning]).Infof("[WARN][%s]%s", l.prefix, fmt.Sprintf(format, args...))
+	l.printf(LevelWarning, format, args...)
 }
 
-// Errorf method, output ERROR level log
+// Errorf method, output ERROR level log to the error stream
 func (l *Logging) Errorf(format string, args ...interface{}) {
-	klog.V(loggingLevel[LevelError]).Infof("[ERROR][%s]%s", l.prefix, fmt.Sprintf(format, args...))
+	l.printf(LevelError, format, args...)
 }
 
-// Fatalf method, output FATAL level log
+// Fatalf method, output FATAL level log to the error stream, then flush the logs and exit with code 1
 func (l *Logging) Fatalf(format string, args ...interface{}) {
-	klog.V(loggingLevel[LevelFatal]).Infof("[FATAL][%s]%s", l.prefix, fmt.Sprintf(format, args...))
+	l.printf(LevelFatal, format, args...)
+	ExitFunc(1)
+}
+
+// Debug method, output DEBUG level structured log
+func (l *Logging) Debug(msg string, keysAndValues ...interface{}) {
+	l.output(2, LevelDebug, nil, msg, keysAndValues)
+}
+
+// Info method, output INFO level structured log
+func (l *Logging) Info(msg string, keysAndValues ...interface{}) {
+	l.output(2, LevelInfo, nil, msg, keysAndValues)
+}
+
+// Warn method, output WARN level structured log
+func (l *Logging) Warn(msg string, keysAndValues ...interface{}) {
+	l.output(2, LevelWarning, nil, msg, keysAndValues)
+}
+
+// Error method, output ERROR level structured log with the error to the error stream
+func (l *Logging) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.output(2, LevelError, err, msg, keysAndValues)
+}
+
+// Fatal method, output FATAL level structured log with the error to the error stream, then flush the logs and exit with code 1
+func (l *Logging) Fatal(err error, msg string, keysAndValues ...interface{}) {
+	l.output(2, LevelFatal, err, msg, keysAndValues)
+	ExitFunc(1)
+}
+
+// WithValues returns a child Logging adding the key/value pairs to every structured log
+func (l *Logging) WithValues(keysAndValues ...interface{}) *Logging {
+	values := make([]interface{}, 0, len(l.values)+len(keysAndValues))
+	values = append(append(values, l.values...), keysAndValues...)
+	return &Logging{prefix: l.prefix, values: values}
+}
+
+// contextKey is the context key of the key/value pairs of a Logging
+type contextKey struct{}
+
+// NewContext returns a copy of the context carrying the key/value pairs of the Logging,
+// e.g. the controller, key and reconcile ID of a reconcile
+func NewContext(ctx context.Context, l *Logging) context.Context {
+	return context.WithValue(ctx, contextKey{}, l.values)
+}
+
+// FromContext returns a child Logging adding the key/value pairs carried by the context to every log,
+// or the Logging itself if the context carries none
+func (l *Logging) FromContext(ctx context.Context) *Logging {
+	values, _ := ctx.Value(contextKey{}).([]interface{})
+	if len(values) == 0 {
+		return l
+	}
+	return l.WithValues(values...)
+}
+
+// enabled reports whether logs of the level are written for the prefix, fatal logs always are
+func (l *Logging) enabled(lvl int32) bool {
+	return lvl == LevelFatal || lvl <= levelOf(l.prefix)
+}
+
+// printf writes a printf-style log with the severity of the level, as a structured log in JSON format
+func (l *Logging) printf(lvl int32, format string, args ...interface{}) {
+	if !l.enabled(lvl) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if structured.Load() {
+		l.output(3, lvl, nil, strings.TrimSpace(msg), nil)
+		return
+	}
+	line := fmt.Sprintf("[%s][%s]%s", levelName[lvl], l.prefix, msg)
+	if len(l.values) > 0 {
+		line = strings.TrimRight(line, "\n") + formatValues(l.values)
+	}
+	switch lvl {
+	case LevelFatal, LevelError:
+		klog.ErrorDepth(2, line)
+	case LevelWarning:
+		klog.WarningDepth(2, line)
+	default:
+		klog.InfoDepth(2, line)
+	}
+}
+
+// output writes a structured log with the severity of the level, attributed to the caller depth frames up
+func (l *Logging) output(depth int, lvl int32, err error, msg string, keysAndValues []interface{}) {
+	if !l.enabled(lvl) {
+		return
+	}
+	kv := l.keysAndValues(lvl, keysAndValues)
+	switch lvl {
+	case LevelFatal, LevelError:
+		klog.ErrorSDepth(depth, err, msg, kv...)
+	default:
+		klog.InfoSDepth(depth, msg, kv...)
+	}
+}
+
+// keysAndValues prepends the logger name, level and the values of the Logging to the key/value pairs
+func (l *Logging) keysAndValues(lvl int32, keysAndValues []interface{}) []interface{} {
+	kv := make([]interface{}, 0, 4+len(l.values)+len(keysAndValues))
+	kv = append(kv, "logger", l.prefix, "level", strings.ToLower(levelName[lvl]))
+	kv = append(kv, l.values...)
+	return append(kv, keysAndValues...)
+}
+
+// formatValues formats the key/value pairs appended to a printf-style log in text format
+func formatValues(keysAndValues []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%q", keysAndValues[i], fmt.Sprint(value))
+	}
+	return b.String()
 }
 
 // NewLogging function, create Logging instance
 func NewLogging(prefix string) *Logging {
-	return &Logging{prefix: prefix, level: level}
+	return &Logging{prefix: prefix}
 }
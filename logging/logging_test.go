@@ -1,6 +1,14 @@
 package logging
 
 import (
+	"Kontroller/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -21,6 +29,102 @@ func TestLogging_Errorf(t *testing.T) {
 	log.Errorf("error message")
 }
 func TestLogging_Fatalf(t *testing.T) {
+	exit := ExitFunc
+	defer func() { ExitFunc = exit }()
+	code := 0
+	ExitFunc = func(c int) { code = c }
 	log := NewLogging("test")
 	log.Fatalf("fatal message")
+	if code != 1 {
+		t.Errorf("exit code is incorrect, got: %d, want: %d.", code, 1)
+	}
+}
+func TestLogging_Fatal(t *testing.T) {
+	exit := ExitFunc
+	defer func() { ExitFunc = exit }()
+	code := 0
+	ExitFunc = func(c int) { code = c }
+	log := NewLogging("test")
+	log.Fatal(errors.New("failure"), "fatal message", "key", "value")
+	if code != 1 {
+		t.Errorf("exit code is incorrect, got: %d, want: %d.", code, 1)
+	}
+}
+func TestLogging_Structured(t *testing.T) {
+	log := NewLogging("test")
+	log.Debug("debug message", "key", "value")
+	log.Info("info message", "key", "value")
+	log.Warn("warn message", "key", "value")
+	log.Error(errors.New("failure"), "error message", "key", "value")
+}
+func TestLogging_WithValues(t *testing.T) {
+	log := NewLogging("test")
+	child := log.WithValues("controller", "reloader")
+	grandchild := child.WithValues("key", "default/app")
+	if len(log.values) != 0 {
+		t.Errorf("Parent values changed, got: %v.", log.values)
+	}
+	if len(child.values) != 2 || len(grandchild.values) != 4 {
+		t.Errorf("Values count is incorrect, got: %d and %d, want: %d and %d.", len(child.values), len(grandchild.values), 2, 4)
+	}
+	kv := grandchild.keysAndValues(LevelInfo, []interface{}{"retries", 1})
+	want := []interface{}{"logger", "test", "level", "info", "controller", "reloader", "key", "default/app", "retries", 1}
+	if fmt.Sprint(kv) != fmt.Sprint(want) {
+		t.Errorf("Key/value pairs are incorrect, got: %v, want: %v.", kv, want)
+	}
+}
+func TestLogging_FromContext(t *testing.T) {
+	reconcileLog := NewLogging("manager").WithValues("controller", "reloader", "key", "default/app")
+	ctx := NewContext(context.Background(), reconcileLog)
+	log := NewLogging("reloader")
+	child := log.FromContext(ctx)
+	if child.prefix != "reloader" {
+		t.Errorf("Prefix is incorrect, got: %s, want: %s.", child.prefix, "reloader")
+	}
+	if want := []interface{}{"controller", "reloader", "key", "default/app"}; fmt.Sprint(child.values) != fmt.Sprint(want) {
+		t.Errorf("Values are incorrect, got: %v, want: %v.", child.values, want)
+	}
+	if log.FromContext(context.Background()) != log {
+		t.Errorf("Logging without context values is not returned as is.")
+	}
+	if got, want := formatValues(child.values), ` controller="reloader" key="default/app"`; got != want {
+		t.Errorf("Formatted values are incorrect, got: %s, want: %s.", got, want)
+	}
+}
+func TestSetFormat_JSON(t *testing.T) {
+	var out bytes.Buffer
+	jsonOutput = &out
+	defer applyConfig(config.Cfg.Log)
+	applyConfig(config.Log{Level: LevelDebug, Format: FormatJSON})
+	defer func() {
+		setFormat(FormatText)
+		jsonOutput = os.Stderr
+	}()
+	log := NewLogging("test").WithValues("controller", "reloader")
+	log.Infof("info message %d\n", 1)
+	log.Error(errors.New("failure"), "error message", "key", "value")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("JSON lines count is incorrect, got: %d, want: %d, output: %s", len(lines), 2, out.String())
+	}
+	want := []map[string]interface{}{
+		{"msg": "info message 1", "logger": "test", "level": "info", "controller": "reloader"},
+		{"msg": "error message", "logger": "test", "level": "error", "controller": "reloader", "key": "value", "error": "failure"},
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line is not JSON: %s", line)
+		}
+		for key, value := range want[i] {
+			if entry[key] != value {
+				t.Errorf("Field %s of line %d is incorrect, got: %v, want: %v.", key, i, entry[key], value)
+			}
+		}
+		// The printf and the structured API both report the call site.
+		caller, _ := entry["caller"].(map[string]interface{})
+		if caller["file"] != "logging_test.go" {
+			t.Errorf("Caller of line %d is incorrect, got: %v, want: %s.", i, entry["caller"], "logging_test.go")
+		}
+	}
 }
@@ -2,15 +2,22 @@
 package main
 
 import (
+	"Kontroller/config"
 	"Kontroller/controllers/cfgReloader"
+	"Kontroller/controllers/pvcCleaner"
+	"Kontroller/controllers/stsPodService"
 	"Kontroller/logging"
 	"Kontroller/pkg/api"
 	"Kontroller/pkg/manager"
 	"flag"
+	"github.com/spf13/pflag"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
 var log *logging.Logging
@@ -22,35 +29,95 @@ func main() {
 	// Define variables.
 	var kubeconfig *string
 	var err error
-	config := &rest.Config{}
+	restConfig := &rest.Config{}
 	// Set the kubeconfig file path.
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) abs path to the kubeconfig file")
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "abs path to the kubeconfig file")
 	}
-	flag.Parse()
+	// Parse the flags, including the klog flags and the overrides of the config settings.
+	flags := pflag.CommandLine
+	flags.AddGoFlagSet(flag.CommandLine)
+	configFile := flags.String("config", "", "(optional) path to the config file, config.yaml is searched if unset")
+	config.AddFlags(flags)
+	pflag.Parse()
+	// Load the config file, overridden by the flags and the KONTROLLER_* environment variables.
+	cfg, err := config.Load(*configFile, flags)
+	if err != nil {
+		log.Fatalf("load config failed:\n%v", err)
+	}
+	config.Set(cfg)
 	// Get the kubernetes config.
-	if config, err = rest.InClusterConfig(); err != nil {
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if restConfig, err = rest.InClusterConfig(); err != nil {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
 		if err != nil {
-			log.Fatalf("get kube config failed")
-			panic(err)
+			log.Fatalf("get kube config failed: %s", err)
 		}
 	}
 	// Create a new manager.
-	mgr := manager.NewManager(config)
+	mgr := manager.NewManager(restConfig)
 	// Register the cfgReloader controller.
 	var _ api.Controller = (*cfgReloader.Reloader)(nil)
-	r := cfgReloader.NewReloader("reloader")
+	r := cfgReloader.NewReloader(cfgReloader.ReloaderName, controllerOptions(cfgReloader.ReloaderName, cfgReloader.ConfigOptions)...)
 	mgr.RegisController(r)
+	// Register the secret reloader controller.
+	sr := cfgReloader.NewSecretReloader(cfgReloader.SecretReloaderName, controllerOptions(cfgReloader.SecretReloaderName, cfgReloader.ConfigOptions)...)
+	mgr.RegisController(sr)
+	// Register the pvcCleaner controller.
+	var _ api.Controller = (*pvcCleaner.Cleaner)(nil)
+	c := pvcCleaner.NewCleaner(pvcCleaner.CleanerName, controllerOptions(pvcCleaner.CleanerName, pvcCleaner.ConfigOptions)...)
+	mgr.RegisController(c)
+	// Register the stsPodService controller.
+	var _ api.Controller = (*stsPodService.PodService)(nil)
+	ps := stsPodService.NewPodService(stsPodService.PodServiceName, controllerOptions(stsPodService.PodServiceName, stsPodService.ConfigOptions)...)
+	mgr.RegisController(ps)
+	// Watch the config file to apply changes live.
+	config.OnChange(mgr.ApplyConfig)
+	config.Watch(*configFile, flags, func(err error) {
+		log.Errorf("config reload rejected: %v", err)
+	})
 	// Run the controllers.
 	stopper := make(chan struct{})
-	defer close(stopper)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	mgr.ServeMetrics(config.Cfg.Manager.MetricsAddress, stopper)
+	mgr.ServeHealthProbes(config.Cfg.Manager.HealthProbeAddress, stopper)
+	mgr.ServeAdmin(config.Cfg.Manager.AdminAddress, stopper)
 	mgr.RunControllers(stopper)
-	// Wait for the stopper to close.
+	// Wait for a termination signal or the leader lease to be lost.
+	exitCode := 0
 	select {
-	case <-stopper:
-		log.Infof("manager closed")
+	case sig := <-signals:
+		log.Infof("received signal %s, shutting down", sig)
+	case <-mgr.LeaderLost():
+		log.Errorf("leader lease lost, shutting down")
+		exitCode = 1
+	}
+	// A second signal forces the exit.
+	go func() {
+		sig := <-signals
+		log.Errorf("received signal %s again, exit", sig)
+		os.Exit(1)
+	}()
+	// Stop the controllers and wait for them to drain their queues. Reconciles still running after the
+	// shutdown timeout are cancelled and get a grace period to return.
+	close(stopper)
+	shutdownTimeout := config.Cfg.Manager.ShutdownTimeout + manager.ShutdownGracePeriod
+	if !mgr.WaitForShutdown(shutdownTimeout) {
+		log.Errorf("controllers not stopped within %s, exit", shutdownTimeout)
+		exitCode = 1
+	}
+	log.Infof("manager closed")
+	os.Exit(exitCode)
+}
+
+// controllerOptions returns the options of the named controller from its settings in the config,
+// exiting if the settings are invalid.
+func controllerOptions[O any](name string, configOptions func(config.ControllerSettings) ([]O, error)) []O {
+	options, err := configOptions(config.Cfg.ControllerSettings(name))
+	if err != nil {
+		log.Fatalf("controller %s settings invalid: %v", name, err)
 	}
+	return options
 }
@@ -0,0 +1,33 @@
+package api
+
+import "context"
+
+// handlerAdapter adapts a Controller to a Reconciler
+type handlerAdapter struct {
+	Controller
+}
+
+// AsReconciler returns a Reconciler calling HandleObject of the controller, and HandleDeletion for
+// deleted objects if the controller is a DeletionHandler. HandleObject is not cancelled by the context.
+func AsReconciler(controller Controller) Reconciler {
+	if reconciler, ok := controller.(Reconciler); ok {
+		return reconciler
+	}
+	return handlerAdapter{controller}
+}
+
+// Reconcile handles the object of the request, or its deletion
+func (a handlerAdapter) Reconcile(_ context.Context, req Request) (Result, error) {
+	if req.Object != nil {
+		return Result{}, a.HandleObject(req.Client, req.Object)
+	}
+	if deletionHandler, ok := a.Controller.(DeletionHandler); ok {
+		return Result{}, deletionHandler.HandleDeletion(req.Client, req.Key, req.LastKnownState)
+	}
+	return Result{}, nil
+}
+
+// Unwrap returns the adapted controller
+func (a handlerAdapter) Unwrap() Controller {
+	return a.Controller
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"testing"
+)
+
+// testController records the objects and deletions it handled.
+type testController struct {
+	objects []interface{}
+	deleted []string
+}
+
+func (t *testController) ControllerName() string        { return "test" }
+func (t *testController) ControlObject() runtime.Object { return &corev1.ConfigMap{} }
+func (t *testController) ControlResourceName() string   { return "configmaps" }
+func (t *testController) ControlNamespace() string      { return corev1.NamespaceAll }
+func (t *testController) ControlLabelSelector() string  { return "" }
+func (t *testController) HandleObject(client kubernetes.Interface, object interface{}) error {
+	t.objects = append(t.objects, object)
+	return nil
+}
+
+// testDeletionController also handles deletions.
+type testDeletionController struct {
+	testController
+}
+
+func (t *testDeletionController) HandleDeletion(client kubernetes.Interface, key string, lastKnownState interface{}) error {
+	t.deleted = append(t.deleted, key)
+	return nil
+}
+
+func TestAsReconciler(t *testing.T) {
+	controller := &testController{}
+	reconciler := AsReconciler(controller)
+	configMap := &corev1.ConfigMap{}
+	if _, err := reconciler.Reconcile(context.Background(), Request{Key: "default/a", Object: configMap}); err != nil {
+		t.Fatalf("Reconcile failed with err: %v", err)
+	}
+	if len(controller.objects) != 1 || controller.objects[0] != configMap {
+		t.Errorf("Handled objects are incorrect, got: %v.", controller.objects)
+	}
+	// Deletions are skipped without DeletionHandler.
+	if _, err := reconciler.Reconcile(context.Background(), Request{Key: "default/a"}); err != nil {
+		t.Fatalf("Reconcile failed with err: %v", err)
+	}
+	if len(controller.objects) != 1 {
+		t.Errorf("Deleted object is handled as an object, got: %v.", controller.objects)
+	}
+	deletionController := &testDeletionController{}
+	if _, err := AsReconciler(deletionController).Reconcile(context.Background(), Request{Key: "default/a"}); err != nil {
+		t.Fatalf("Reconcile failed with err: %v", err)
+	}
+	if len(deletionController.deleted) != 1 || deletionController.deleted[0] != "default/a" {
+		t.Errorf("Deleted keys are incorrect, got: %v.", deletionController.deleted)
+	}
+}
@@ -3,19 +3,61 @@ package api
 
 // Import required packages
 import (
+	"context"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
+	"time"
 )
 
-// Controller is an interface for Kubernetes controllers
-type Controller interface {
+// Resource is an interface describing the objects watched by a controller
+type Resource interface {
 	ControllerName() string
 	ControlObject() runtime.Object
 	ControlResourceName() string
 	ControlNamespace() string
 	ControlLabelSelector() string
-	HandleObject(client *kubernetes.Clientset, object interface{}) error
+}
+
+// Controller is an interface for Kubernetes controllers
+type Controller interface {
+	Resource
+	HandleObject(client kubernetes.Interface, object interface{}) error
+}
+
+// Request is the object of a key to reconcile
+type Request struct {
+	Key            string               // namespace/name key of the object
+	Namespace      string               // namespace of the object, empty if cluster scoped
+	Name           string               // name of the object
+	Object         interface{}          // object in the informer cache, nil if deleted
+	LastKnownState interface{}          // object last seen by the informer if deleted, nil if unknown
+	Client         kubernetes.Interface // client of the controller
+}
+
+// Result is the result of a successful reconcile. An empty Result finishes the key and resets its backoff.
+type Result struct {
+	// Requeue requeues the key with the backoff of the rate limiter, e.g. to poll a progress.
+	Requeue bool
+	// RequeueAfter requeues the key after the duration, resetting its backoff. It takes precedence over Requeue.
+	RequeueAfter time.Duration
+}
+
+// Reconciler is the context-aware interface for Kubernetes controllers. The context is cancelled when the
+// reconcile timeout of the controller or the shutdown timeout is exceeded. It carries the controller, key and
+// reconcile ID logged by the loggers returned by logging.Logging.FromContext.
+type Reconciler interface {
+	Resource
+	Reconcile(ctx context.Context, req Request) (Result, error)
+}
+
+// DeletionHandler is an optional interface for controllers handling the deletion of their objects.
+// Deletions are skipped for controllers not implementing it.
+type DeletionHandler interface {
+	// HandleDeletion handles the deleted object of the key. lastKnownState is the object last seen by the
+	// informer, possibly stale if the deletion was missed while watching, or nil if unknown.
+	HandleDeletion(client kubernetes.Interface, key string, lastKnownState interface{}) error
 }
 
 // EventHandler is an interface for Kubernetes event handlers
@@ -24,3 +66,10 @@ type EventHandler interface {
 	UpdateEventHandlerFunc(queue workqueue.RateLimitingInterface) func(oldObj interface{}, newObj interface{})
 	DeleteEventHandlerFunc(queue workqueue.RateLimitingInterface) func(obj interface{})
 }
+
+// Watcher is an optional interface for controllers whose objects are also affected by other resources.
+// The informers are run along the controller, which starts reconciling once their caches synced.
+type Watcher interface {
+	// Watch returns the informers of the other resources, adding the keys of the affected objects to the queue.
+	Watch(client kubernetes.Interface, queue workqueue.RateLimitingInterface, resyncPeriod time.Duration) []cache.Controller
+}
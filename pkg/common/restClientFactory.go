@@ -32,7 +32,7 @@ const (
 )
 
 // CacheGetterMap maps resource names to functions that return a cache getter for that resource.
-var CacheGetterMap = map[string]func(clientset *kubernetes.Clientset) cache.Getter{
+var CacheGetterMap = map[string]func(clientset kubernetes.Interface) cache.Getter{
 	ConfigMaps:             getCoreV1RESTClient,
 	Endpoints:              getCoreV1RESTClient,
 	Events:                 getCoreV1RESTClient,
@@ -58,31 +58,31 @@ var CacheGetterMap = map[string]func(clientset *kubernetes.Clientset) cache.Gett
 }
 
 // getCoreV1RESTClient returns a cache getter for the CoreV1 API group.
-func getCoreV1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getCoreV1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.CoreV1().RESTClient()
 }
 
 // getAppsV1RESTClient returns a cache getter for the AppsV1 API group.
-func getAppsV1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getAppsV1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.AppsV1().RESTClient()
 }
 
 // getBatchV1beta1RESTClient returns a cache getter for the BatchV1beta1 API group.
-func getBatchV1beta1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getBatchV1beta1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.BatchV1beta1().RESTClient()
 }
 
 // getExtensionsV1beta1RESTClient returns a cache getter for the ExtensionsV1beta1 API group.
-func getExtensionsV1beta1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getExtensionsV1beta1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.ExtensionsV1beta1().RESTClient()
 }
 
 // getNetworkingV1RESTClient returns a cache getter for the NetworkingV1 API group.
-func getNetworkingV1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getNetworkingV1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.NetworkingV1().RESTClient()
 }
 
 // getRbacV1RESTClient returns a cache getter for the RbacV1 API group.
-func getRbacV1RESTClient(clientset *kubernetes.Clientset) cache.Getter {
+func getRbacV1RESTClient(clientset kubernetes.Interface) cache.Getter {
 	return clientset.RbacV1().RESTClient()
 }
@@ -2,25 +2,50 @@ package manager
 
 import (
 	"Kontroller/config"
+	"Kontroller/logging"
 	"Kontroller/pkg/api"
 	"Kontroller/pkg/common"
+	"Kontroller/pkg/metrics"
+	"context"
 	"fmt"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ConcreteController struct {
-	Controller api.Controller
+	Controller api.Reconciler
 	Queue      workqueue.RateLimitingInterface
-	Client     *kubernetes.Clientset
+	Client     kubernetes.Interface
 	ListWatch  *cache.ListWatch
 	Indexer    cache.Indexer
 	Informer   cache.Controller
+	Watchers   []cache.Controller
+	Recorder   record.EventRecorder
+	state      atomic.Int32
+	lastActive atomic.Int64
+	maxRetries atomic.Pointer[int32]
+	timeout    atomic.Pointer[time.Duration]
+	limiter    rateLimiter
+	ctx        context.Context
+	workersMu  sync.Mutex
+	stopper    <-chan struct{}
+	workerStop []chan struct{}
+	threads    int
+	workers    sync.WaitGroup
+	tombstones sync.Map
 }
 
 // AddEventHandlerFunc returns a function that adds an object to the queue
@@ -43,63 +68,238 @@ func (c *ConcreteController) UpdateEventHandlerFunc(queue workqueue.RateLimiting
 	}
 }
 
-// DeleteEventHandlerFunc returns a function that deletes an object from the queue
+// DeleteEventHandlerFunc returns a function that records the last known state of a deleted object,
+// unwrapping tombstones, and adds the object to the queue
 func (c *ConcreteController) DeleteEventHandlerFunc(queue workqueue.RateLimitingInterface) func(obj interface{}) {
 	return func(obj interface{}) {
 		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-		if err == nil {
-			queue.Add(key)
+		if err != nil {
+			return
 		}
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		c.tombstones.Store(key, obj)
+		queue.Add(key)
 	}
 }
 
-// Run starts the controller with the specified number of threads and stopper channel
+// Run starts the controller with the specified number of threads, unless resized before, and stopper channel.
+// Once the stopper is closed, the queue is drained and Run returns after all workers exited. The context of the
+// reconciles is only cancelled if the queue is not drained within the shutdown timeout.
 func (c *ConcreteController) Run(stopper <-chan struct{}, threads int) {
 	defer runtime.HandleCrash()
-	defer c.Queue.ShuttingDown()
 	name := c.Controller.ControllerName()
 	log.Infof("start controller: %s\n", name)
+	c.state.Store(stateSyncing)
+	defer c.state.Store(stateStopped)
 	go c.Informer.Run(stopper)
-	if !cache.WaitForCacheSync(stopper, c.Informer.HasSynced) {
+	for _, watcher := range c.Watchers {
+		go watcher.Run(stopper)
+	}
+	if !cache.WaitForCacheSync(stopper, c.hasSynced) {
+		c.Queue.ShutDown()
 		runtime.HandleError(fmt.Errorf("time out wait for cache to sync of controller:%s\n, please check if the controller run property\n", name))
 		return
 	}
-	for i := 0; i < threads; i++ {
-		go wait.Until(func() {
-			for c.ProcessNextItem() {
-			}
-		}, config.Cfg.Manager.ThreadTimeout, stopper)
+	c.markActive()
+	c.state.Store(stateRunning)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.workersMu.Lock()
+	c.ctx = ctx
+	c.stopper = stopper
+	if c.threads == 0 {
+		c.threads = threads
 	}
+	threads = c.threads
+	c.workersMu.Unlock()
+	c.SetWorkers(threads)
 	<-stopper
+	log.Infof("stopping controller: %s, draining queue\n", name)
+	timeout := time.AfterFunc(config.Cfg.Manager.ShutdownTimeout, cancel)
+	defer timeout.Stop()
+	c.Queue.ShutDownWithDrain()
+	c.workersMu.Lock()
+	c.stopper = nil
+	for _, stop := range c.workerStop {
+		close(stop)
+	}
+	c.workerStop = nil
+	c.workersMu.Unlock()
+	c.workers.Wait()
 	log.Infof("stop controller: %s\n", name)
 }
 
-// processNextItem processes the next item in the queue
+// hasSynced reports whether the informer and the watchers of the controller synced their caches.
+func (c *ConcreteController) hasSynced() bool {
+	for _, watcher := range c.Watchers {
+		if !watcher.HasSynced() {
+			return false
+		}
+	}
+	return c.Informer.HasSynced()
+}
+
+// SetWorkers resizes the worker pool of the running controller to the number of threads.
+// A removed worker exits once it finished its current item.
+func (c *ConcreteController) SetWorkers(threads int) {
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	c.threads = threads
+	if c.stopper == nil {
+		return
+	}
+	for len(c.workerStop) < threads {
+		stop := make(chan struct{})
+		c.workerStop = append(c.workerStop, stop)
+		c.workers.Add(1)
+		go c.worker(stop)
+	}
+	for len(c.workerStop) > threads {
+		last := len(c.workerStop) - 1
+		close(c.workerStop[last])
+		c.workerStop = c.workerStop[:last]
+	}
+}
+
+// Workers returns the number of workers of the controller.
+func (c *ConcreteController) Workers() int {
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	return c.threads
+}
+
+// worker processes items until its stop channel is closed.
+func (c *ConcreteController) worker(stop <-chan struct{}) {
+	defer c.workers.Done()
+	wait.Until(func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if !c.ProcessNextItem() {
+				return
+			}
+		}
+	}, config.Cfg.Manager.ThreadTimeout, stop)
+}
+
+// SetMaxRetries sets the max retry times of failed items, overriding the configured one.
+func (c *ConcreteController) SetMaxRetries(maxRetries int32) {
+	c.maxRetries.Store(&maxRetries)
+}
+
+// MaxRetries returns the max retry times of failed items.
+func (c *ConcreteController) MaxRetries() int32 {
+	if maxRetries := c.maxRetries.Load(); maxRetries != nil {
+		return *maxRetries
+	}
+	return config.Cfg.Manager.ControllerMaxRetryTimes
+}
+
+// SetReconcileTimeout sets the timeout of reconciling an item, overriding the configured one.
+func (c *ConcreteController) SetReconcileTimeout(timeout time.Duration) {
+	c.timeout.Store(&timeout)
+}
+
+// ReconcileTimeout returns the timeout of reconciling an item.
+func (c *ConcreteController) ReconcileTimeout() time.Duration {
+	if timeout := c.timeout.Load(); timeout != nil {
+		return *timeout
+	}
+	return config.Cfg.Manager.ReconcileTimeout
+}
+
+// SetRateLimiter replaces the rate limiter of the queue, resetting the backoff of the failed items.
+func (c *ConcreteController) SetRateLimiter(settings config.RateLimiter) {
+	c.limiter.set(newRateLimiter(settings))
+}
+
+// context returns the context of the running controller, cancelled on shutdown.
+func (c *ConcreteController) context() context.Context {
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// ProcessNextItem processes the next item in the queue. It returns false only once the queue is shut down,
+// so workers keep draining the queue after failures.
 func (c *ConcreteController) ProcessNextItem() bool {
 	key, shutdown := c.Queue.Get()
 	if shutdown {
 		return false
 	}
+	c.markActive()
+	defer c.markActive()
 	defer c.Queue.Done(key)
 	name := c.Controller.ControllerName()
-	obj, exists, err := c.Indexer.GetByKey(key.(string))
+	reconcileLog := log.WithValues("controller", name, "key", key, "reconcileID", uuid.NewUUID())
+	start := time.Now()
+	reconcileLog.Debug("reconcile started")
+	result, handleErr := c.handle(key.(string), reconcileLog)
+	metrics.ReconcileDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	reconcileLog.Debug("reconcile finished", "duration", time.Since(start))
+	metrics.ReconcileTotal.WithLabelValues(name).Inc()
+	if handleErr != nil {
+		metrics.ReconcileErrors.WithLabelValues(name).Inc()
+	}
+	retries := c.Queue.NumRequeues(key)
+	action := nextAction(result, handleErr, retries, int(c.MaxRetries()))
+	c.applyAction(action, key, result)
+	switch action {
+	case actionRetry:
+		reconcileLog.Error(handleErr, "handle object failed, requeued", "retries", retries+1)
+	case actionDrop:
+		reconcileLog.Error(handleErr, "handle object failed finally, dropped", "retries", retries)
+		c.recordDropped(key.(string), retries, handleErr)
+		c.tombstones.Delete(key)
+	case actionRequeueAfter:
+		reconcileLog.Debug("reconcile requeued", "after", result.RequeueAfter)
+	case actionRequeue:
+		reconcileLog.Debug("reconcile requeued with backoff", "retries", retries+1)
+	}
+	return true
+}
+
+// handle reconciles the object of the key, or its deletion with the last known state, within the
+// reconcile timeout.
+func (c *ConcreteController) handle(key string, reconcileLog *logging.Logging) (api.Result, error) {
+	obj, exists, err := c.Indexer.GetByKey(key)
 	if err != nil {
-		log.Errorf("controller %s fetching object %s from local cache failed with err: %v\n, internal err, you may need restart\n", name, key, err)
+		return api.Result{}, fmt.Errorf("fetching object from local cache failed: %w", err)
 	}
-	if !exists {
-		log.Infof("controller %s object %s has been deleted\n", name, key)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return api.Result{}, err
 	}
-	handleErr := c.Controller.HandleObject(c.Client, obj)
-	if handleErr != nil {
-		if c.Queue.NumRequeues(key) < int(config.Cfg.Manager.ControllerMaxRetryTimes) {
-			c.Queue.AddRateLimited(key)
-			log.Errorf("controller %s handle obj %s failed %d times with err:%v\n", name, key, err)
-			return false
+	req := api.Request{Key: key, Namespace: namespace, Name: name, Client: c.Client}
+	if exists {
+		c.tombstones.Delete(key)
+		req.Object = obj
+	} else {
+		// The last known state is kept until the deletion is handled, so that retries get it too.
+		if lastKnownState, deleted := c.tombstones.Load(key); deleted {
+			req.LastKnownState = lastKnownState
+			reconcileLog.Info("object has been deleted")
+		} else {
+			// e.g. missed deletions, or keys enqueued by watchers for objects the informer does not select
+			reconcileLog.Debug("object not in cache")
 		}
-		log.Errorf("controller %s handle obj %s failed finally: %v\n", name, key, err)
-		return false
 	}
-	return true
+	ctx, cancel := context.WithTimeout(logging.NewContext(c.context(), reconcileLog), c.ReconcileTimeout())
+	defer cancel()
+	result, err := c.Controller.Reconcile(ctx, req)
+	if err != nil {
+		return api.Result{}, err
+	}
+	c.tombstones.Delete(key)
+	return result, nil
 }
 
 // build ConcreteController with fluentApi style
@@ -108,7 +308,7 @@ type (
 		ConcreteController *ConcreteController
 	}
 	ControllerBuilder interface {
-		Controller(controller api.Controller) QueueBuilder
+		Controller(controller api.Reconciler) QueueBuilder
 	}
 	QueueBuilder interface {
 		Queue() ClientBuilder
@@ -127,7 +327,7 @@ type (
 	}
 )
 
-func (c *ConcreteControllerBuilder) Controller(controller api.Controller) QueueBuilder {
+func (c *ConcreteControllerBuilder) Controller(controller api.Reconciler) QueueBuilder {
 	if c.ConcreteController == nil {
 		c.ConcreteController = &ConcreteController{}
 	}
@@ -135,24 +335,31 @@ func (c *ConcreteControllerBuilder) Controller(controller api.Controller) QueueB
 	return c
 }
 func (c *ConcreteControllerBuilder) Queue() ClientBuilder {
-	c.ConcreteController.Queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	name := c.ConcreteController.Controller.ControllerName()
+	c.ConcreteController.SetRateLimiter(config.Cfg.ControllerSettings(name).RateLimiter)
+	c.ConcreteController.Queue = workqueue.NewRateLimitingQueueWithConfig(&c.ConcreteController.limiter, workqueue.RateLimitingQueueConfig{
+		Name:            name,
+		MetricsProvider: metrics.QueueMetricsProvider{},
+	})
 	return c
 }
 func (c *ConcreteControllerBuilder) Client(config *rest.Config) ListWatchBuilder {
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		log.Fatalf("NewForConfig err with:%s\n, please check if the config file is right\n", err)
-		panic(err)
 	}
 	c.ConcreteController.Client = client
+	// Record the events of the controller, e.g. on objects given up after the max retry times.
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	c.ConcreteController.Recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kontroller-" + c.ConcreteController.Controller.ControllerName()})
 	return c
 }
 func (c *ConcreteControllerBuilder) ListWatch() IndexerInformerBuilder {
 	resourceName := c.ConcreteController.Controller.ControlResourceName()
 	restClient, ok := common.CacheGetterMap[resourceName]
 	if !ok {
-		log.Fatalf("rest client get err, please check if the resource name incorrect. or check CacheGetterMap factory, if the resource supported.\n")
-		panic(fmt.Errorf("resource not supported: %s\n", resourceName))
+		log.Fatalf("rest client get err of resource %s, please check if the resource name incorrect. or check CacheGetterMap factory, if the resource supported.\n", resourceName)
 	}
 	listOptions := func(options *metav1.ListOptions) {
 		options.LabelSelector = c.ConcreteController.Controller.ControlLabelSelector()
@@ -168,14 +375,14 @@ func (c *ConcreteControllerBuilder) IndexerInformer() EndBuilder {
 	addFunc := c.ConcreteController.AddEventHandlerFunc(queue)
 	updateFunc := c.ConcreteController.UpdateEventHandlerFunc(queue)
 	deleteFunc := c.ConcreteController.DeleteEventHandlerFunc(queue)
-	if _, ok := interface{}(controller).(api.EventHandler); ok {
-		addFunc = interface{}(controller).(api.EventHandler).AddEventHandlerFunc(queue)
-		updateFunc = interface{}(controller).(api.EventHandler).UpdateEventHandlerFunc(queue)
-		deleteFunc = interface{}(controller).(api.EventHandler).DeleteEventHandlerFunc(queue)
+	if eventHandler, ok := unwrap(controller).(api.EventHandler); ok {
+		addFunc = eventHandler.AddEventHandlerFunc(queue)
+		updateFunc = eventHandler.UpdateEventHandlerFunc(queue)
+		deleteFunc = eventHandler.DeleteEventHandlerFunc(queue)
 	}
 	lw := c.ConcreteController.ListWatch
 	obj := c.ConcreteController.Controller.ControlObject()
-	Period := config.Cfg.Manager.ReSyncPeriod
+	Period := config.Cfg.ControllerSettings(controller.ControllerName()).ReSyncPeriod
 	indexer, informer := cache.NewIndexerInformer(lw, obj, Period, cache.ResourceEventHandlerFuncs{
 		AddFunc:    addFunc,
 		UpdateFunc: updateFunc,
@@ -183,8 +390,19 @@ func (c *ConcreteControllerBuilder) IndexerInformer() EndBuilder {
 	}, cache.Indexers{})
 	c.ConcreteController.Indexer = indexer
 	c.ConcreteController.Informer = informer
+	if watcher, ok := unwrap(controller).(api.Watcher); ok {
+		c.ConcreteController.Watchers = watcher.Watch(c.ConcreteController.Client, queue, Period)
+	}
 	return c
 }
+
+// unwrap returns the controller adapted by api.AsReconciler, or the reconciler itself.
+func unwrap(reconciler api.Reconciler) interface{} {
+	if adapter, ok := reconciler.(interface{ Unwrap() api.Controller }); ok {
+		return adapter.Unwrap()
+	}
+	return reconciler
+}
 func (c *ConcreteControllerBuilder) Build() *ConcreteController {
 	return c.ConcreteController
 }
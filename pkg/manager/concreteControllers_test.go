@@ -0,0 +1,497 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"Kontroller/logging"
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/metrics"
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testController records the objects it handled, optionally reporting them started
+// and blocking on release first.
+type testController struct {
+	mu      sync.Mutex
+	handled []string
+	started chan string
+	release chan struct{}
+}
+
+func (t *testController) ControllerName() string        { return "test" }
+func (t *testController) ControlObject() runtime.Object { return &corev1.ConfigMap{} }
+func (t *testController) ControlResourceName() string   { return "configmaps" }
+func (t *testController) ControlNamespace() string      { return corev1.NamespaceAll }
+func (t *testController) ControlLabelSelector() string  { return "" }
+func (t *testController) HandleObject(client kubernetes.Interface, object interface{}) error {
+	if configmap, ok := object.(*corev1.ConfigMap); ok && t.started != nil {
+		t.started <- configmap.Name
+	}
+	if t.release != nil {
+		<-t.release
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if configmap, ok := object.(*corev1.ConfigMap); ok {
+		t.handled = append(t.handled, configmap.Name)
+	}
+	return nil
+}
+
+func (t *testController) handledCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.handled)
+}
+
+// newTestConcreteController builds a ConcreteController watching configmaps of a fake clientset.
+func newTestConcreteController(controller *testController, objects ...runtime.Object) *ConcreteController {
+	client := fake.NewSimpleClientset(objects...)
+	c := &ConcreteController{
+		Controller: api.AsReconciler(controller),
+		Queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		Client:     client,
+		ListWatch: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().ConfigMaps(corev1.NamespaceAll).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().ConfigMaps(corev1.NamespaceAll).Watch(context.TODO(), options)
+			},
+		},
+	}
+	c.Indexer, c.Informer = cache.NewIndexerInformer(c.ListWatch, &corev1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.AddEventHandlerFunc(c.Queue),
+		UpdateFunc: c.UpdateEventHandlerFunc(c.Queue),
+		DeleteFunc: c.DeleteEventHandlerFunc(c.Queue),
+	}, cache.Indexers{})
+	return c
+}
+
+func newTestConfigMap(name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+func TestConcreteController_Run_DrainsOnStop(t *testing.T) {
+	controller := &testController{release: make(chan struct{})}
+	c := newTestConcreteController(controller, newTestConfigMap("a"))
+	stopper := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(stopper, 1)
+		close(stopped)
+	}()
+	// Wait until the worker is handling the object, then stop the controller.
+	for c.Queue.Len() != 0 || !c.Informer.HasSynced() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopper)
+	select {
+	case <-stopped:
+		t.Fatalf("Run returned while an object was still being handled.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(controller.release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the queue was drained.")
+	}
+	if controller.handledCount() != 1 {
+		t.Errorf("Handled objects count is incorrect, got: %d, want: %d.", controller.handledCount(), 1)
+	}
+	if !c.Queue.ShuttingDown() {
+		t.Errorf("Queue not shut down after the controller stopped.")
+	}
+}
+
+// testWatcher is an informer of other resources synced on demand.
+type testWatcher struct {
+	cache.Controller
+	started chan struct{}
+	synced  atomic.Bool
+}
+
+func (w *testWatcher) Run(stopCh <-chan struct{}) {
+	close(w.started)
+	<-stopCh
+}
+func (w *testWatcher) HasSynced() bool { return w.synced.Load() }
+
+func TestConcreteController_Run_WaitsForWatchers(t *testing.T) {
+	controller := &testController{}
+	c := newTestConcreteController(controller, newTestConfigMap("a"))
+	watcher := &testWatcher{started: make(chan struct{})}
+	c.Watchers = []cache.Controller{watcher}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	go c.Run(stopper, 1)
+	select {
+	case <-watcher.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watcher not started with the controller.")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if c.Synced() || controller.handledCount() != 0 {
+		t.Errorf("Controller reconciling before the watcher synced.")
+	}
+	watcher.synced.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for controller.handledCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if controller.handledCount() != 1 || !c.Synced() {
+		t.Errorf("Controller not reconciling after the watcher synced.")
+	}
+}
+
+func TestManager_WaitForShutdown(t *testing.T) {
+	controller := &testController{release: make(chan struct{})}
+	m := &Manager{Items: map[string]*ConcreteController{"test": newTestConcreteController(controller, newTestConfigMap("a"))}}
+	stopper := make(chan struct{})
+	m.runControllers(stopper)
+	for m.Items["test"].Queue.Len() != 0 || !m.Items["test"].Informer.HasSynced() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopper)
+	if m.WaitForShutdown(100 * time.Millisecond) {
+		t.Errorf("WaitForShutdown returned true while an object was still being handled.")
+	}
+	close(controller.release)
+	if !m.WaitForShutdown(5 * time.Second) {
+		t.Errorf("WaitForShutdown timed out after the queue was drained.")
+	}
+}
+
+func TestConcreteController_ProcessNextItem_Metrics(t *testing.T) {
+	controller := &testController{}
+	c := newTestConcreteController(controller)
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	c.Queue.Add("default/a")
+	before := testutil.ToFloat64(metrics.ReconcileTotal.WithLabelValues("test"))
+	c.ProcessNextItem()
+	if got := testutil.ToFloat64(metrics.ReconcileTotal.WithLabelValues("test")) - before; got != 1 {
+		t.Errorf("Reconcile total increase is incorrect, got: %v, want: %v.", got, 1)
+	}
+}
+
+func TestConcreteController_SetWorkers(t *testing.T) {
+	controller := &testController{started: make(chan string, 3), release: make(chan struct{})}
+	c := newTestConcreteController(controller, newTestConfigMap("a"), newTestConfigMap("b"), newTestConfigMap("c"))
+	stopper := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(stopper, 1)
+		close(stopped)
+	}()
+	<-controller.started
+	if c.Workers() != 1 {
+		t.Errorf("Workers count is incorrect, got: %d, want: %d.", c.Workers(), 1)
+	}
+	// The added workers handle the other objects while the first one is blocked.
+	c.SetWorkers(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-controller.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Added workers did not handle the queued objects.")
+		}
+	}
+	c.SetWorkers(1)
+	close(controller.release)
+	close(stopper)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the workers were resized.")
+	}
+	if controller.handledCount() != 3 {
+		t.Errorf("Handled objects count is incorrect, got: %d, want: %d.", controller.handledCount(), 3)
+	}
+}
+
+func TestManager_ApplyConfig(t *testing.T) {
+	c := newTestConcreteController(&testController{})
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}}
+	old := config.Cfg
+	cfg := config.Cfg
+	cfg.Manager.ThreadNumber = old.Manager.ThreadNumber + 2
+	cfg.Manager.ControllerMaxRetryTimes = old.Manager.ControllerMaxRetryTimes + 1
+	m.ApplyConfig(old, cfg)
+	if c.Workers() != int(cfg.Manager.ThreadNumber) {
+		t.Errorf("Workers count is incorrect, got: %d, want: %d.", c.Workers(), cfg.Manager.ThreadNumber)
+	}
+	if c.MaxRetries() != cfg.Manager.ControllerMaxRetryTimes {
+		t.Errorf("Max retry times is incorrect, got: %d, want: %d.", c.MaxRetries(), cfg.Manager.ControllerMaxRetryTimes)
+	}
+}
+
+// testDeletionController records the keys and last known states of the deletions it handled.
+type testDeletionController struct {
+	testController
+	deleted []string
+	states  []interface{}
+	err     error
+}
+
+func (t *testDeletionController) HandleDeletion(client kubernetes.Interface, key string, lastKnownState interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deleted = append(t.deleted, key)
+	t.states = append(t.states, lastKnownState)
+	return t.err
+}
+
+func TestConcreteController_ProcessNextItem_Deletion(t *testing.T) {
+	controller := &testDeletionController{}
+	c := newTestConcreteController(&controller.testController)
+	c.Controller = api.AsReconciler(controller)
+	// A tombstone of a deletion missed while watching is unwrapped to the last known state.
+	configMap := newTestConfigMap("a")
+	c.DeleteEventHandlerFunc(c.Queue)(cache.DeletedFinalStateUnknown{Key: "default/a", Obj: configMap})
+	c.ProcessNextItem()
+	if len(controller.deleted) != 1 || controller.deleted[0] != "default/a" {
+		t.Fatalf("Deleted keys are incorrect, got: %v, want: %v.", controller.deleted, []string{"default/a"})
+	}
+	if controller.states[0] != configMap {
+		t.Errorf("Last known state is incorrect, got: %v, want: %v.", controller.states[0], configMap)
+	}
+	if controller.handledCount() != 0 {
+		t.Errorf("Deleted object is handled as an object.")
+	}
+	if _, ok := c.tombstones.Load("default/a"); ok {
+		t.Errorf("Last known state is kept after the deletion was handled.")
+	}
+}
+
+func TestConcreteController_ProcessNextItem_DeletionRetry(t *testing.T) {
+	controller := &testDeletionController{err: errors.New("failure")}
+	c := newTestConcreteController(&controller.testController)
+	c.Controller = api.AsReconciler(controller)
+	c.Queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond))
+	configMap := newTestConfigMap("a")
+	c.DeleteEventHandlerFunc(c.Queue)(configMap)
+	c.ProcessNextItem()
+	controller.err = nil
+	c.ProcessNextItem()
+	if len(controller.states) != 2 || controller.states[1] != configMap {
+		t.Errorf("Last known state is not passed to the retry, got: %v.", controller.states)
+	}
+}
+
+func TestConcreteController_ProcessNextItem_DeletionSkipped(t *testing.T) {
+	controller := &testController{}
+	c := newTestConcreteController(controller)
+	c.DeleteEventHandlerFunc(c.Queue)(newTestConfigMap("a"))
+	if !c.ProcessNextItem() {
+		t.Errorf("Skipped deletion is not processed successfully.")
+	}
+	if controller.handledCount() != 0 {
+		t.Errorf("Deleted object is handled by a controller without DeletionHandler.")
+	}
+	if _, ok := c.tombstones.Load("default/a"); ok {
+		t.Errorf("Last known state is kept after the deletion was skipped.")
+	}
+}
+
+// testReconciler blocks reconciling until its context is done, recording the context errors.
+type testReconciler struct {
+	testController
+	started chan struct{}
+	errs    chan error
+}
+
+func (t *testReconciler) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	t.started <- struct{}{}
+	<-ctx.Done()
+	t.errs <- ctx.Err()
+	return api.Result{}, ctx.Err()
+}
+
+func newTestReconciler() *testReconciler {
+	return &testReconciler{started: make(chan struct{}, 1), errs: make(chan error, 1)}
+}
+
+func TestConcreteController_ProcessNextItem_Timeout(t *testing.T) {
+	reconciler := newTestReconciler()
+	c := newTestConcreteController(&reconciler.testController)
+	c.Controller = reconciler
+	c.SetReconcileTimeout(50 * time.Millisecond)
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	c.Queue.Add("default/a")
+	c.ProcessNextItem()
+	if c.Queue.NumRequeues("default/a") != 1 {
+		t.Errorf("Timed out reconcile is not retried, got: %d requeues.", c.Queue.NumRequeues("default/a"))
+	}
+	if err := <-reconciler.errs; err != context.DeadlineExceeded {
+		t.Errorf("Context err is incorrect, got: %v, want: %v.", err, context.DeadlineExceeded)
+	}
+}
+
+// testDrainReconciler blocks reconciling until released, recording the context errors.
+type testDrainReconciler struct {
+	testReconciler
+	release chan struct{}
+}
+
+func (t *testDrainReconciler) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	t.started <- struct{}{}
+	<-t.release
+	t.errs <- ctx.Err()
+	return api.Result{}, ctx.Err()
+}
+
+func TestConcreteController_Run_DrainsBeforeCancel(t *testing.T) {
+	reconciler := &testDrainReconciler{testReconciler: *newTestReconciler(), release: make(chan struct{})}
+	c := newTestConcreteController(&reconciler.testController, newTestConfigMap("a"))
+	c.Controller = reconciler
+	stopper := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(stopper, 1)
+		close(stopped)
+	}()
+	<-reconciler.started
+	close(stopper)
+	time.Sleep(100 * time.Millisecond)
+	close(reconciler.release)
+	if err := <-reconciler.errs; err != nil {
+		t.Errorf("Drained reconcile context is done with err: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the queue was drained.")
+	}
+}
+
+func TestConcreteController_Run_CancelsOnShutdownTimeout(t *testing.T) {
+	shutdownTimeout := config.Cfg.Manager.ShutdownTimeout
+	config.Cfg.Manager.ShutdownTimeout = 100 * time.Millisecond
+	defer func() { config.Cfg.Manager.ShutdownTimeout = shutdownTimeout }()
+	reconciler := newTestReconciler()
+	c := newTestConcreteController(&reconciler.testController, newTestConfigMap("a"))
+	c.Controller = reconciler
+	c.SetReconcileTimeout(time.Hour)
+	stopper := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(stopper, 1)
+		close(stopped)
+	}()
+	<-reconciler.started
+	close(stopper)
+	select {
+	case err := <-reconciler.errs:
+		if err != context.Canceled {
+			t.Errorf("Context err is incorrect, got: %v, want: %v.", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reconcile context not cancelled on stop.")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the reconcile was cancelled.")
+	}
+}
+
+func TestManager_WaitForShutdown_GracePeriod(t *testing.T) {
+	shutdownTimeout := config.Cfg.Manager.ShutdownTimeout
+	config.Cfg.Manager.ShutdownTimeout = 100 * time.Millisecond
+	defer func() { config.Cfg.Manager.ShutdownTimeout = shutdownTimeout }()
+	reconciler := newTestReconciler()
+	c := newTestConcreteController(&reconciler.testController, newTestConfigMap("a"))
+	c.Controller = reconciler
+	c.SetReconcileTimeout(time.Hour)
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}}
+	stopper := make(chan struct{})
+	m.runControllers(stopper)
+	<-reconciler.started
+	close(stopper)
+	if !m.WaitForShutdown(config.Cfg.Manager.ShutdownTimeout + ShutdownGracePeriod) {
+		t.Errorf("WaitForShutdown timed out although the reconcile returned once cancelled.")
+	}
+	if err := <-reconciler.errs; err != context.Canceled {
+		t.Errorf("Context err is incorrect, got: %v, want: %v.", err, context.Canceled)
+	}
+}
+
+// testResultReconciler returns the result for every reconcile.
+type testResultReconciler struct {
+	testController
+	result api.Result
+}
+
+func (t *testResultReconciler) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	return t.result, nil
+}
+
+func TestConcreteController_ProcessNextItem_Result(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   api.Result
+		requeues int
+		requeued bool
+	}{
+		{"done", api.Result{}, 0, false},
+		{"requeue", api.Result{Requeue: true}, 2, true},
+		{"requeue after", api.Result{RequeueAfter: 10 * time.Millisecond}, 0, true},
+	}
+	for _, test := range tests {
+		reconciler := &testResultReconciler{result: test.result}
+		c := newTestConcreteController(&reconciler.testController)
+		c.Controller = reconciler
+		c.Queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond))
+		_ = c.Indexer.Add(newTestConfigMap("a"))
+		// A former failure is forgotten by a done or delayed result, and kept by a backoff requeue.
+		c.Queue.AddRateLimited("default/a")
+		if !c.ProcessNextItem() {
+			t.Errorf("%s: reconcile is not processed successfully.", test.name)
+		}
+		if got := c.Queue.NumRequeues("default/a"); got != test.requeues {
+			t.Errorf("%s: requeues are incorrect, got: %d, want: %d.", test.name, got, test.requeues)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if requeued := c.Queue.Len() == 1; requeued != test.requeued {
+			t.Errorf("%s: requeued is incorrect, got: %v, want: %v.", test.name, requeued, test.requeued)
+		}
+	}
+}
+
+// testContextReconciler records the context of the last reconcile.
+type testContextReconciler struct {
+	testController
+	ctx context.Context
+}
+
+func (t *testContextReconciler) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	t.ctx = ctx
+	return api.Result{}, nil
+}
+
+func TestConcreteController_ProcessNextItem_LogContext(t *testing.T) {
+	reconciler := &testContextReconciler{}
+	c := newTestConcreteController(&reconciler.testController)
+	c.Controller = reconciler
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	c.Queue.Add("default/a")
+	c.ProcessNextItem()
+	controllerLog := logging.NewLogging("test")
+	if reconciler.ctx == nil || controllerLog.FromContext(reconciler.ctx) == controllerLog {
+		t.Errorf("Reconcile context carries no log values.")
+	}
+}
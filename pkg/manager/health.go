@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lifecycle states of a ConcreteController.
+const (
+	stateIdle int32 = iota
+	stateSyncing
+	stateRunning
+	stateStopped
+)
+
+// markActive records that a worker pulled or finished an item.
+func (c *ConcreteController) markActive() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// Synced reports whether the controller synced its informer caches and runs its workers.
+func (c *ConcreteController) Synced() bool {
+	return c.state.Load() == stateRunning && c.hasSynced()
+}
+
+// Stalled reports whether the queue holds items but no worker pulled or finished one for longer than the threshold.
+func (c *ConcreteController) Stalled(threshold time.Duration) bool {
+	if c.state.Load() != stateRunning || c.Queue.Len() == 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, c.lastActive.Load())) > threshold
+}
+
+// Ready returns an error naming the controllers not synced yet. When leader election is enabled,
+// controllers not started yet are waiting for the lease and do not block the readiness.
+func (m *Manager) Ready() error {
+	var notReady []string
+	for name, c := range m.Items {
+		if c.Synced() || (c.state.Load() == stateIdle && config.Cfg.Manager.LeaderElection.Enabled) {
+			continue
+		}
+		notReady = append(notReady, name)
+	}
+	if len(notReady) > 0 {
+		sort.Strings(notReady)
+		return fmt.Errorf("controllers not synced: %s", strings.Join(notReady, ", "))
+	}
+	return nil
+}
+
+// Healthy returns an error naming the controllers whose workers stalled for longer than the threshold.
+func (m *Manager) Healthy(threshold time.Duration) error {
+	var stalled []string
+	for name, c := range m.Items {
+		if c.Stalled(threshold) {
+			stalled = append(stalled, name)
+		}
+	}
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		return fmt.Errorf("controllers stalled for more than %s: %s", threshold, strings.Join(stalled, ", "))
+	}
+	return nil
+}
+
+// ServeHealthProbes serves the liveness probe on /healthz and the readiness probe on /readyz
+// at the address until the stopper is closed.
+func (m *Manager) ServeHealthProbes(addr string, stopper <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probeHandler(func() error {
+		return m.Healthy(config.Cfg.Manager.LivenessThreshold)
+	}))
+	mux.HandleFunc("/readyz", probeHandler(m.Ready))
+	serveHTTP("health probe", addr, mux, stopper)
+}
+
+// probeHandler responds 200 if the check passes, 503 with the error otherwise.
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}
+}
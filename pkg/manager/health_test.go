@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestManager_Ready(t *testing.T) {
+	c := newTestConcreteController(&testController{}, newTestConfigMap("a"))
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}}
+	if m.Ready() == nil {
+		t.Errorf("Manager ready before the controllers started.")
+	}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	m.runControllers(stopper)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Ready() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.Ready(); err != nil {
+		t.Errorf("Manager not ready after the controllers synced: %v", err)
+	}
+}
+
+func TestManager_Healthy(t *testing.T) {
+	c := newTestConcreteController(&testController{})
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}}
+	c.state.Store(stateRunning)
+	c.markActive()
+	c.Queue.Add("default/a")
+	if err := m.Healthy(time.Minute); err != nil {
+		t.Errorf("Manager unhealthy with an active worker: %v", err)
+	}
+	c.lastActive.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if m.Healthy(time.Minute) == nil {
+		t.Errorf("Manager healthy although no worker pulled from the queue.")
+	}
+	// An empty queue means idle workers, not stalled ones.
+	key, _ := c.Queue.Get()
+	c.Queue.Done(key)
+	c.lastActive.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if err := m.Healthy(time.Minute); err != nil {
+		t.Errorf("Manager unhealthy with an empty queue: %v", err)
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	m := &Manager{Items: map[string]*ConcreteController{"test": newTestConcreteController(&testController{})}}
+	recorder := httptest.NewRecorder()
+	probeHandler(m.Ready).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readiness status code is incorrect, got: %d, want: %d.", recorder.Code, http.StatusServiceUnavailable)
+	}
+	recorder = httptest.NewRecorder()
+	probeHandler(func() error { return m.Healthy(time.Minute) }).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Liveness status code is incorrect, got: %d, want: %d.", recorder.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"context"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+)
+
+// leaderElect campaigns for the lease and calls run with a context cancelled once the lease is lost.
+// It returns after the lease is lost or ctx is done.
+func leaderElect(ctx context.Context, client kubernetes.Interface, cfg config.LeaderElection, identity string, run func(ctx context.Context)) error {
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, cfg.LeaseNamespace, cfg.LeaseName,
+		client.CoreV1(), client.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		return err
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("%s started leading lease %s/%s\n", identity, cfg.LeaseNamespace, cfg.LeaseName)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s stopped leading lease %s/%s\n", identity, cfg.LeaseNamespace, cfg.LeaseName)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("lease %s/%s is held by %s\n", cfg.LeaseNamespace, cfg.LeaseName, leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(ctx)
+	return nil
+}
+
+// leaderIdentity returns a unique identity of this process for the lease.
+func leaderIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "kontroller"
+	}
+	return fmt.Sprintf("%s_%s", hostname, uuid.NewUUID())
+}
@@ -0,0 +1,170 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"context"
+	"errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testLeaderElection = config.LeaderElection{
+	Enabled:        true,
+	LeaseName:      "kontroller",
+	LeaseNamespace: "default",
+	LeaseDuration:  2 * time.Second,
+	RenewDeadline:  time.Second,
+	RetryPeriod:    100 * time.Millisecond,
+}
+
+func TestLeaderElect(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	leading := make(chan context.Context)
+	done := make(chan error)
+	go func() {
+		done <- leaderElect(ctx, client, testLeaderElection, "replica-a", func(ctx context.Context) {
+			leading <- ctx
+		})
+	}()
+	var leaderCtx context.Context
+	select {
+	case leaderCtx = <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leader election did not start leading.")
+	}
+	lease, err := client.CoordinationV1().Leases("default").Get(context.TODO(), "kontroller", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Lease not created: %v", err)
+	}
+	if holder := *lease.Spec.HolderIdentity; holder != "replica-a" {
+		t.Errorf("Lease holder is incorrect, got: %s, want: %s.", holder, "replica-a")
+	}
+	// Stopping releases the lease and cancels the leading context.
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Leader election failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leader election did not return after cancel.")
+	}
+	if leaderCtx.Err() == nil {
+		t.Errorf("Leading context not cancelled after losing the lease.")
+	}
+}
+
+func TestLeaderElect_Follower(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	defer cancelLeader()
+	leading := make(chan struct{})
+	go func() {
+		_ = leaderElect(leaderCtx, client, testLeaderElection, "replica-a", func(ctx context.Context) {
+			close(leading)
+		})
+	}()
+	<-leading
+	followerCtx, cancelFollower := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFollower()
+	err := leaderElect(followerCtx, client, testLeaderElection, "replica-b", func(ctx context.Context) {
+		t.Errorf("Follower started leading while the lease is held.")
+	})
+	if err != nil {
+		t.Errorf("Leader election failed: %v", err)
+	}
+}
+
+// leaseHolder returns the holder of the test lease, empty if released.
+func leaseHolder(client *fake.Clientset) string {
+	lease, err := client.CoordinationV1().Leases("default").Get(context.TODO(), "kontroller", metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestManager_RunWithLeaderElection_ReleasesAfterDrain(t *testing.T) {
+	leaderElection := config.Cfg.Manager.LeaderElection
+	config.Cfg.Manager.LeaderElection = testLeaderElection
+	defer func() { config.Cfg.Manager.LeaderElection = leaderElection }()
+	reconciler := &testDrainReconciler{testReconciler: *newTestReconciler(), release: make(chan struct{})}
+	c := newTestConcreteController(&reconciler.testController, newTestConfigMap("a"))
+	c.Controller = reconciler
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}, leaderLost: make(chan struct{})}
+	client := fake.NewSimpleClientset()
+	stopper := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.runWithLeaderElection(stopper, client)
+		close(done)
+	}()
+	select {
+	case <-reconciler.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Controllers not started by the leader.")
+	}
+	close(stopper)
+	time.Sleep(300 * time.Millisecond)
+	if leaseHolder(client) == "" {
+		t.Errorf("Lease released while the controllers are draining.")
+	}
+	close(reconciler.release)
+	if err := <-reconciler.errs; err != nil {
+		t.Errorf("Drained reconcile context is done with err: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leader election did not return after the controllers drained.")
+	}
+	if holder := leaseHolder(client); holder != "" {
+		t.Errorf("Lease not released after the controllers drained, held by %s.", holder)
+	}
+	select {
+	case <-m.LeaderLost():
+		t.Errorf("Leader lost reported on stop.")
+	default:
+	}
+}
+
+func TestManager_RunWithLeaderElection_LeaderLost(t *testing.T) {
+	leaderElection := config.Cfg.Manager.LeaderElection
+	config.Cfg.Manager.LeaderElection = testLeaderElection
+	defer func() { config.Cfg.Manager.LeaderElection = leaderElection }()
+	controller := &testController{started: make(chan string, 1)}
+	c := newTestConcreteController(controller, newTestConfigMap("a"))
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}, leaderLost: make(chan struct{})}
+	client := fake.NewSimpleClientset()
+	var unreachable atomic.Bool
+	client.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if unreachable.Load() {
+			return true, nil, errors.New("unreachable")
+		}
+		return false, nil, nil
+	})
+	stopper := make(chan struct{})
+	defer close(stopper)
+	go m.runWithLeaderElection(stopper, client)
+	select {
+	case <-controller.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Controllers not started by the leader.")
+	}
+	// Renewing the lease fails, e.g. as the API server is unreachable.
+	unreachable.Store(true)
+	select {
+	case <-m.LeaderLost():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Leader lost not reported after the lease was taken over.")
+	}
+	if !m.WaitForShutdown(5 * time.Second) {
+		t.Errorf("Controllers not stopped after the lease was lost.")
+	}
+}
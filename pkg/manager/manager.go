@@ -3,30 +3,59 @@ package manager
 
 import (
 	"Kontroller/config"
+	"Kontroller/logging"
 	"Kontroller/pkg/api"
+	"Kontroller/pkg/metrics"
+	"context"
 	"fmt"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"net/http"
+	"sync"
+	"time"
 )
 
+// ShutdownGracePeriod is the time the reconciles are given to return once the shutdown timeout cancelled
+// their contexts. The manager waits the shutdown timeout plus this period before giving up.
+const ShutdownGracePeriod = 5 * time.Second
+
 // Manager represents a controller manager.
 type Manager struct {
-	Items  map[string]*ConcreteController
-	Config *rest.Config
+	Items      map[string]*ConcreteController
+	Config     *rest.Config
+	leaderLost chan struct{}
+	running    sync.WaitGroup
 }
 
 // NewManager creates a new instance of Manager.
 func NewManager(config *rest.Config) *Manager {
-	return &Manager{Config: config}
+	return &Manager{Config: config, leaderLost: make(chan struct{})}
+}
+
+// LeaderLost returns a channel closed once the manager lost the leader lease and stopped its controllers.
+func (m *Manager) LeaderLost() <-chan struct{} {
+	return m.leaderLost
 }
 
-// RegisController registers a controller with the manager.
+// RegisController registers a controller with the manager, adapted to a Reconciler.
 func (m *Manager) RegisController(controller api.Controller) {
+	m.RegisReconciler(api.AsReconciler(controller))
+}
+
+// RegisReconciler registers a context-aware controller with the manager.
+func (m *Manager) RegisReconciler(controller api.Reconciler) {
 	// Initialize the Items map if it is nil.
 	if m.Items == nil {
 		m.Items = make(map[string]*ConcreteController)
 	}
 	name := controller.ControllerName()
+	// Skip the controller if disabled in the config.
+	settings := config.Cfg.ControllerSettings(name)
+	if !settings.Enabled {
+		log.Infof("controller %s disabled\n", name)
+		return
+	}
 	// Check if the controller is already registered.
 	if _, ok := m.Items[name]; ok {
 		log.Infof("controller %s already registered\n", name)
@@ -34,6 +63,8 @@ func (m *Manager) RegisController(controller api.Controller) {
 	}
 	// Create a new ConcreteController and add it to the Items map.
 	concreteController := NewConcreteControllerBuilder().Controller(controller).Queue().Client(m.Config).ListWatch().IndexerInformer().Build()
+	concreteController.SetMaxRetries(settings.MaxRetries)
+	concreteController.SetReconcileTimeout(settings.ReconcileTimeout)
 	m.Items[name] = concreteController
 	log.Infof("controller %s registered successfully\n", name)
 	return
@@ -57,7 +88,8 @@ func (m *Manager) DeregisController(name string) {
 	return
 }
 
-// RunControllers runs all registered controllers.
+// RunControllers runs all registered controllers. If leader election is enabled,
+// the controllers only run while the manager holds the leader lease.
 func (m *Manager) RunControllers(stopper <-chan struct{}) {
 	// Check if there are any controllers to run.
 	if m.Items == nil {
@@ -65,9 +97,132 @@ func (m *Manager) RunControllers(stopper <-chan struct{}) {
 		runtime.HandleError(fmt.Errorf("no controllers in manager to run"))
 		return
 	}
-	// Run each controller in a separate goroutine.
-	for _, concreteController := range m.Items {
-		go concreteController.Run(stopper, int(config.Cfg.Manager.ThreadNumber))
+	if !config.Cfg.Manager.LeaderElection.Enabled {
+		m.runControllers(stopper)
+		return
+	}
+	client, err := kubernetes.NewForConfig(m.Config)
+	if err != nil {
+		log.Errorf("create leader election client failed with err: %v\n", err)
+		runtime.HandleError(err)
+		return
 	}
+	go m.runWithLeaderElection(stopper, client)
 	return
 }
+
+// runWithLeaderElection campaigns for the leader lease and runs the controllers while leading.
+// Closing the stopper releases the lease only after the controllers drained their queues, so no other
+// replica runs them meanwhile. Losing the lease stops the controllers and closes the LeaderLost channel.
+func (m *Manager) runWithLeaderElection(stopper <-chan struct{}, client kubernetes.Interface) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	stopped := false
+	go func() {
+		select {
+		case <-stopper:
+			// No controllers are started once stopped, so they can be waited for.
+			mu.Lock()
+			stopped = true
+			mu.Unlock()
+			m.running.Wait()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := leaderElect(ctx, client, config.Cfg.Manager.LeaderElection, leaderIdentity(), func(ctx context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-stopper:
+			case <-ctx.Done():
+			}
+			close(stop)
+		}()
+		m.runControllers(stop)
+	})
+	if err != nil {
+		log.Errorf("leader election failed with err: %v\n", err)
+		runtime.HandleError(err)
+	}
+	select {
+	case <-stopper:
+	default:
+		close(m.leaderLost)
+	}
+}
+
+// runControllers runs each controller in a separate goroutine until the stopper is closed.
+func (m *Manager) runControllers(stopper <-chan struct{}) {
+	for _, concreteController := range m.Items {
+		m.running.Add(1)
+		go func(concreteController *ConcreteController) {
+			defer m.running.Done()
+			concreteController.Run(stopper, int(config.Cfg.ControllerSettings(concreteController.Controller.ControllerName()).Workers))
+		}(concreteController)
+	}
+}
+
+// ApplyConfig applies the live settings of a changed configuration to the controllers,
+// and logs the changed settings which require a restart.
+func (m *Manager) ApplyConfig(old, cfg config.Config) {
+	for name, concreteController := range m.Items {
+		before, after := old.ControllerSettings(name), cfg.ControllerSettings(name)
+		if before.Workers != after.Workers {
+			concreteController.SetWorkers(int(after.Workers))
+			log.Infof("controller %s resized to %d workers\n", name, after.Workers)
+		}
+		if before.MaxRetries != after.MaxRetries {
+			concreteController.SetMaxRetries(after.MaxRetries)
+			log.Infof("controller %s max retry times set to %d\n", name, after.MaxRetries)
+		}
+		if before.ReconcileTimeout != after.ReconcileTimeout {
+			concreteController.SetReconcileTimeout(after.ReconcileTimeout)
+			log.Infof("controller %s reconcile timeout set to %s\n", name, after.ReconcileTimeout)
+		}
+		if before.RateLimiter != after.RateLimiter {
+			concreteController.SetRateLimiter(after.RateLimiter)
+			log.Infof("controller %s rate limiter set to %+v\n", name, after.RateLimiter)
+		}
+	}
+	for _, setting := range config.RestartRequired(old, cfg) {
+		log.Warnf("config %s changed, requires restart\n", setting)
+	}
+}
+
+// WaitForShutdown waits until all controllers drained their queues and stopped after the stopper
+// was closed. It returns false if the controllers did not stop within the timeout.
+func (m *Manager) WaitForShutdown(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ServeMetrics serves the prometheus metrics on /metrics at the address until the stopper is closed.
+func (m *Manager) ServeMetrics(addr string, stopper <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	serveHTTP("metrics", addr, mux, stopper)
+}
+
+// ServeAdmin serves the runtime log levels on /debug/loglevel at the address until the stopper is closed.
+// The endpoint is unauthenticated, so the address should only be reachable by the operators.
+func (m *Manager) ServeAdmin(addr string, stopper <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/loglevel", logging.Handler())
+	serveHTTP("admin", addr, mux, stopper)
+}
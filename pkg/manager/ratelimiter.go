@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newRateLimiter returns the queue rate limiter of the settings.
+func newRateLimiter(settings config.RateLimiter) workqueue.RateLimiter {
+	exponential := workqueue.NewItemExponentialFailureRateLimiter(settings.BaseDelay, settings.MaxDelay)
+	bucket := &workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(settings.QPS), int(settings.Burst))}
+	switch strings.ToLower(settings.Type) {
+	case config.RateLimiterExponential:
+		return exponential
+	case config.RateLimiterBucket:
+		return &countingRateLimiter{RateLimiter: bucket, failures: map[interface{}]int{}}
+	default:
+		return workqueue.NewMaxOfRateLimiter(exponential, bucket)
+	}
+}
+
+// countingRateLimiter counts the failures of the items limited by a rate limiter not tracking them,
+// like workqueue.BucketRateLimiter, so that the max retries of the controller apply.
+type countingRateLimiter struct {
+	workqueue.RateLimiter
+	mu       sync.Mutex
+	failures map[interface{}]int
+}
+
+// When counts the failure of the item and returns its delay.
+func (r *countingRateLimiter) When(item interface{}) time.Duration {
+	r.mu.Lock()
+	r.failures[item]++
+	r.mu.Unlock()
+	return r.RateLimiter.When(item)
+}
+
+// Forget resets the failures of the item.
+func (r *countingRateLimiter) Forget(item interface{}) {
+	r.mu.Lock()
+	delete(r.failures, item)
+	r.mu.Unlock()
+	r.RateLimiter.Forget(item)
+}
+
+// NumRequeues returns the number of failures of the item.
+func (r *countingRateLimiter) NumRequeues(item interface{}) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures[item]
+}
+
+// rateLimiter is a queue rate limiter whose limiter is replaced live.
+// Replacing the limiter resets the backoff and retry counts of the failed items.
+type rateLimiter struct {
+	limiter atomic.Pointer[workqueue.RateLimiter]
+}
+
+// set replaces the limiter.
+func (r *rateLimiter) set(limiter workqueue.RateLimiter) {
+	r.limiter.Store(&limiter)
+}
+
+// When returns the delay of the item.
+func (r *rateLimiter) When(item interface{}) time.Duration {
+	return (*r.limiter.Load()).When(item)
+}
+
+// Forget stops tracking the item.
+func (r *rateLimiter) Forget(item interface{}) {
+	(*r.limiter.Load()).Forget(item)
+}
+
+// NumRequeues returns the number of failures of the item.
+func (r *rateLimiter) NumRequeues(item interface{}) int {
+	return (*r.limiter.Load()).NumRequeues(item)
+}
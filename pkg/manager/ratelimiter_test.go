@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"Kontroller/config"
+	"Kontroller/pkg/api"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	settings := config.RateLimiter{BaseDelay: time.Second, MaxDelay: 4 * time.Second, QPS: 1, Burst: 1}
+	tests := []struct {
+		limiter string
+		want    []time.Duration
+	}{
+		// The failures of an item are delayed exponentially up to the max delay.
+		{config.RateLimiterExponential, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}},
+		// Distinct items share the bucket, but the first one fits in the burst.
+		{config.RateLimiterBucket, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}},
+	}
+	for _, test := range tests {
+		settings.Type = test.limiter
+		limiter := newRateLimiter(settings)
+		for i, want := range test.want {
+			item := "a"
+			if test.limiter == config.RateLimiterBucket {
+				item = string(rune('a' + i))
+			}
+			if got := limiter.When(item); got.Round(100*time.Millisecond) != want {
+				t.Errorf("Delay %d of the %s limiter is incorrect, got: %v, want: %v.", i, test.limiter, got, want)
+			}
+		}
+	}
+	settings.Type = config.RateLimiterMax
+	limiter := newRateLimiter(settings)
+	if got := limiter.When("a"); got != time.Second {
+		t.Errorf("Delay of the max limiter is incorrect, got: %v, want: %v.", got, time.Second)
+	}
+	if got := limiter.When("b").Round(100 * time.Millisecond); got != time.Second {
+		t.Errorf("Delay of the max limiter is incorrect, got: %v, want: %v.", got, time.Second)
+	}
+}
+
+func TestNewRateLimiter_BucketCountsFailures(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimiter{Type: config.RateLimiterBucket, QPS: 100, Burst: 100})
+	for i := 0; i < 3; i++ {
+		limiter.When("a")
+	}
+	// The max retries of the controller apply to the bucket limiter as well.
+	if action := nextAction(api.Result{}, errors.New("failed"), limiter.NumRequeues("a"), 3); action != actionDrop {
+		t.Errorf("Action after the max retries is incorrect, got: %v, want: %v.", action, actionDrop)
+	}
+	limiter.Forget("a")
+	if got := limiter.NumRequeues("a"); got != 0 {
+		t.Errorf("Requeue count after forget is incorrect, got: %d, want: %d.", got, 0)
+	}
+}
+
+func TestConcreteController_SetRateLimiter(t *testing.T) {
+	c := newTestConcreteController(&testController{})
+	settings := config.RateLimiter{Type: config.RateLimiterExponential, BaseDelay: time.Second, MaxDelay: time.Minute, QPS: 1, Burst: 1}
+	c.SetRateLimiter(settings)
+	c.limiter.When("a")
+	if got := c.limiter.NumRequeues("a"); got != 1 {
+		t.Errorf("Requeue count is incorrect, got: %d, want: %d.", got, 1)
+	}
+	m := &Manager{Items: map[string]*ConcreteController{"test": c}}
+	old := config.Cfg
+	cfg := config.Cfg
+	cfg.Manager.RateLimiter = settings
+	cfg.Manager.RateLimiter.BaseDelay = 2 * time.Second
+	m.ApplyConfig(old, cfg)
+	if got := c.limiter.When("a"); got != 2*time.Second {
+		t.Errorf("Delay of the replaced limiter is incorrect, got: %v, want: %v.", got, 2*time.Second)
+	}
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// retryAction is the action taken on a key after reconciling it.
+type retryAction int
+
+const (
+	// actionForget finishes the key and resets its backoff.
+	actionForget retryAction = iota
+	// actionRequeueAfter requeues the key after the delay of the result and resets its backoff.
+	actionRequeueAfter
+	// actionRequeue requeues the key with backoff as asked by the result.
+	actionRequeue
+	// actionRetry requeues the failed key with backoff.
+	actionRetry
+	// actionDrop gives up the failed key after the max retry times and resets its backoff.
+	actionDrop
+)
+
+// String returns the name of the action.
+func (a retryAction) String() string {
+	switch a {
+	case actionRequeueAfter:
+		return "requeueAfter"
+	case actionRequeue:
+		return "requeue"
+	case actionRetry:
+		return "retry"
+	case actionDrop:
+		return "drop"
+	default:
+		return "forget"
+	}
+}
+
+// nextAction returns the action on a key reconciled with the result and error, after it was
+// requeued with backoff the number of times.
+func nextAction(result api.Result, err error, requeues int, maxRetries int) retryAction {
+	switch {
+	case err != nil && requeues < maxRetries:
+		return actionRetry
+	case err != nil:
+		return actionDrop
+	case result.RequeueAfter > 0:
+		return actionRequeueAfter
+	case result.Requeue:
+		return actionRequeue
+	default:
+		return actionForget
+	}
+}
+
+// applyAction applies the action on the key to the queue, updating the metrics.
+func (c *ConcreteController) applyAction(action retryAction, key interface{}, result api.Result) {
+	name := c.Controller.ControllerName()
+	switch action {
+	case actionForget:
+		c.Queue.Forget(key)
+	case actionRequeueAfter:
+		c.Queue.Forget(key)
+		c.Queue.AddAfter(key, result.RequeueAfter)
+		metrics.ReconcileRequeues.WithLabelValues(name).Inc()
+	case actionRequeue, actionRetry:
+		c.Queue.AddRateLimited(key)
+		metrics.ReconcileRequeues.WithLabelValues(name).Inc()
+	case actionDrop:
+		c.Queue.Forget(key)
+		metrics.ReconcileDropped.WithLabelValues(name).Inc()
+	}
+}
+
+// recordDropped emits a warning event on the object of the dropped key, or on its last known state
+// if deleted. Nothing is emitted without recorder or known object.
+func (c *ConcreteController) recordDropped(key string, retries int, err error) {
+	if c.Recorder == nil {
+		return
+	}
+	obj, exists, _ := c.Indexer.GetByKey(key)
+	if !exists {
+		obj, _ = c.tombstones.Load(key)
+	}
+	if object, ok := obj.(runtime.Object); ok {
+		c.Recorder.Eventf(object, corev1.EventTypeWarning, "ReconcileFailed", "%s gave up after %d retries: %v", c.Controller.ControllerName(), retries, err)
+	}
+}
@@ -0,0 +1,170 @@
+package manager
+
+import (
+	"Kontroller/pkg/api"
+	"Kontroller/pkg/metrics"
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeQueue is a RateLimitingInterface recording the calls. NumRequeues counts the rate limited adds
+// of an item until it is forgotten, and Get reports a shutdown once the queue is empty.
+type fakeQueue struct {
+	items       []interface{}
+	requeues    map[interface{}]int
+	rateLimited []interface{}
+	forgotten   []interface{}
+	done        []interface{}
+	after       map[interface{}]time.Duration
+}
+
+func newFakeQueue(items ...interface{}) *fakeQueue {
+	return &fakeQueue{items: items, requeues: map[interface{}]int{}, after: map[interface{}]time.Duration{}}
+}
+
+func (q *fakeQueue) Add(item interface{}) { q.items = append(q.items, item) }
+func (q *fakeQueue) Len() int             { return len(q.items) }
+func (q *fakeQueue) Get() (interface{}, bool) {
+	if len(q.items) == 0 {
+		return nil, true
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item, false
+}
+func (q *fakeQueue) Done(item interface{})                      { q.done = append(q.done, item) }
+func (q *fakeQueue) ShutDown()                                  {}
+func (q *fakeQueue) ShutDownWithDrain()                         {}
+func (q *fakeQueue) ShuttingDown() bool                         { return false }
+func (q *fakeQueue) AddAfter(item interface{}, d time.Duration) { q.after[item] = d }
+func (q *fakeQueue) NumRequeues(item interface{}) int           { return q.requeues[item] }
+func (q *fakeQueue) AddRateLimited(item interface{}) {
+	q.rateLimited = append(q.rateLimited, item)
+	q.requeues[item]++
+	q.items = append(q.items, item)
+}
+func (q *fakeQueue) Forget(item interface{}) {
+	q.forgotten = append(q.forgotten, item)
+	delete(q.requeues, item)
+}
+
+// testFailingReconciler fails the first reconciles, then returns the result.
+type testFailingReconciler struct {
+	testController
+	failures int
+	calls    int
+	result   api.Result
+}
+
+func (t *testFailingReconciler) Reconcile(ctx context.Context, req api.Request) (api.Result, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		return api.Result{}, errors.New("failure")
+	}
+	return t.result, nil
+}
+
+func TestNextAction(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		result   api.Result
+		err      error
+		requeues int
+		want     retryAction
+	}{
+		{api.Result{}, nil, 0, actionForget},
+		{api.Result{}, nil, 3, actionForget},
+		{api.Result{RequeueAfter: time.Minute}, nil, 3, actionRequeueAfter},
+		{api.Result{Requeue: true, RequeueAfter: time.Minute}, nil, 0, actionRequeueAfter},
+		{api.Result{Requeue: true}, nil, 0, actionRequeue},
+		{api.Result{}, failure, 0, actionRetry},
+		{api.Result{RequeueAfter: time.Minute}, failure, 4, actionRetry},
+		{api.Result{}, failure, 5, actionDrop},
+	}
+	for _, test := range tests {
+		if got := nextAction(test.result, test.err, test.requeues, 5); got != test.want {
+			t.Errorf("Action of %+v, %v after %d requeues is incorrect, got: %s, want: %s.", test.result, test.err, test.requeues, got, test.want)
+		}
+	}
+}
+
+func TestConcreteController_ProcessNextItem_Retries(t *testing.T) {
+	reconciler := &testFailingReconciler{failures: 2}
+	c := newTestConcreteController(&reconciler.testController)
+	c.Controller = reconciler
+	c.SetMaxRetries(5)
+	queue := newFakeQueue("default/a")
+	c.Queue = queue
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	// Workers keep draining the queue after failures, until it is shut down.
+	for i := 0; i < 3; i++ {
+		if !c.ProcessNextItem() {
+			t.Fatalf("Failed reconcile stopped the worker.")
+		}
+	}
+	if c.ProcessNextItem() {
+		t.Errorf("Shut down queue did not stop the worker.")
+	}
+	if len(queue.rateLimited) != 2 || len(queue.done) != 3 {
+		t.Errorf("Queue calls are incorrect, got: %d rate limited and %d done, want: 2 and 3.", len(queue.rateLimited), len(queue.done))
+	}
+	// The success forgets the backoff of the former failures.
+	if len(queue.forgotten) != 1 || queue.NumRequeues("default/a") != 0 {
+		t.Errorf("Backoff not reset after success, got: %d forgotten and %d requeues.", len(queue.forgotten), queue.NumRequeues("default/a"))
+	}
+}
+
+func TestConcreteController_ProcessNextItem_Drop(t *testing.T) {
+	reconciler := &testFailingReconciler{failures: 10}
+	c := newTestConcreteController(&reconciler.testController)
+	c.Controller = reconciler
+	c.SetMaxRetries(2)
+	recorder := record.NewFakeRecorder(10)
+	c.Recorder = recorder
+	queue := newFakeQueue("default/a")
+	c.Queue = queue
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	before := testutil.ToFloat64(metrics.ReconcileDropped.WithLabelValues("test"))
+	for c.ProcessNextItem() {
+	}
+	if reconciler.calls != 3 {
+		t.Errorf("Reconcile calls are incorrect, got: %d, want: %d.", reconciler.calls, 3)
+	}
+	if got := testutil.ToFloat64(metrics.ReconcileDropped.WithLabelValues("test")) - before; got != 1 {
+		t.Errorf("Dropped increase is incorrect, got: %v, want: %v.", got, 1)
+	}
+	if len(queue.forgotten) != 1 || queue.NumRequeues("default/a") != 0 {
+		t.Errorf("Dropped key not forgotten, got: %d forgotten and %d requeues.", len(queue.forgotten), queue.NumRequeues("default/a"))
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning ReconcileFailed") {
+			t.Errorf("Terminal event is incorrect, got: %s.", event)
+		}
+	default:
+		t.Errorf("No terminal event emitted for the dropped key.")
+	}
+}
+
+func TestConcreteController_ProcessNextItem_RequeueAfter(t *testing.T) {
+	reconciler := &testFailingReconciler{failures: 1, result: api.Result{RequeueAfter: time.Minute}}
+	c := newTestConcreteController(&reconciler.testController)
+	c.Controller = reconciler
+	c.SetMaxRetries(5)
+	queue := newFakeQueue("default/a")
+	c.Queue = queue
+	_ = c.Indexer.Add(newTestConfigMap("a"))
+	for c.ProcessNextItem() {
+	}
+	if queue.after["default/a"] != time.Minute {
+		t.Errorf("Requeue delay is incorrect, got: %v, want: %v.", queue.after["default/a"], time.Minute)
+	}
+	if queue.NumRequeues("default/a") != 0 {
+		t.Errorf("Backoff not reset by the delayed requeue, got: %d requeues.", queue.NumRequeues("default/a"))
+	}
+}
@@ -0,0 +1,32 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"net/http"
+	"time"
+)
+
+// serveHTTP serves the handler at the address in the background until the stopper is closed.
+// An empty address disables the server.
+func serveHTTP(name, addr string, handler http.Handler, stopper <-chan struct{}) {
+	if addr == "" {
+		log.Infof("%s server disabled\n", name)
+		return
+	}
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Infof("%s server listening on %s\n", name, addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("%s server failed with err: %v\n", name, err)
+			runtime.HandleError(err)
+		}
+	}()
+	go func() {
+		<-stopper
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+}
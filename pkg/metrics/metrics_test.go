@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/util/workqueue"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueueMetricsProvider(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+		Name:            "metrics-test",
+		MetricsProvider: QueueMetricsProvider{},
+	})
+	defer queue.ShutDown()
+	// The metrics are global, compare the increase to keep the test repeatable.
+	depthBefore := testutil.ToFloat64(queueDepth.WithLabelValues("metrics-test"))
+	addsBefore := testutil.ToFloat64(queueAdds.WithLabelValues("metrics-test"))
+	queue.Add("a")
+	queue.Add("b")
+	if depth := testutil.ToFloat64(queueDepth.WithLabelValues("metrics-test")) - depthBefore; depth != 2 {
+		t.Errorf("Queue depth increase is incorrect, got: %v, want: %v.", depth, 2)
+	}
+	if adds := testutil.ToFloat64(queueAdds.WithLabelValues("metrics-test")) - addsBefore; adds != 2 {
+		t.Errorf("Queue adds increase is incorrect, got: %v, want: %v.", adds, 2)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ReconcileTotal.WithLabelValues("handler-test").Inc()
+	total := testutil.ToFloat64(ReconcileTotal.WithLabelValues("handler-test"))
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	want := fmt.Sprintf(`kontroller_reconcile_total{controller="handler-test"} %v`, total)
+	if body := recorder.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("Metrics output does not contain the reconcile counter.")
+	}
+}
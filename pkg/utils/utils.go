@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 )
 
-// HashCompute computes the SHA256 hash of the specified object.
+// HashCompute computes the hex encoded SHA256 hash of the specified object.
 func HashCompute(obj interface{}) (string, error) {
 	// Create a new SHA256 hash instance.
 	hashIns := sha256.New()
@@ -19,6 +21,20 @@ func HashCompute(obj interface{}) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	// Compute the final hash and return it as a string.
-	return string(hashIns.Sum(nil)), nil
+	// Compute the final hash and return it as a hex string.
+	return hex.EncodeToString(hashIns.Sum(nil)), nil
+}
+
+// HMACCompute computes the hex encoded HMAC-SHA256 of the specified object keyed with the key,
+// so that only holders of the key can verify guesses of the object.
+func HMACCompute(key []byte, obj interface{}) (string, error) {
+	encodeJson, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	if _, err := mac.Write(encodeJson); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
 }